@@ -78,15 +78,10 @@ func main() {
 	// 注册插件：拦截 channels.weixin.qq.com 的 HTML 响应并注入脚本
 	echoProxy.AddPlugin(&echo.Plugin{
 		Match: "channels.weixin.qq.com",
+		Response: &echo.ResponseMatch{
+			ContentType: []string{"text/html"},
+		},
 		OnResponse: func(ctx *echo.Context) {
-			res := ctx.Res
-			if res == nil {
-				return
-			}
-			contentType := res.Header.Get("Content-Type")
-			if !strings.Contains(contentType, "text/html") {
-				return
-			}
 			html, err := ctx.GetResponseBody()
 			if err != nil {
 				log.Printf("Failed to read response body: %v", err)
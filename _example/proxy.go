@@ -69,19 +69,16 @@ func main() {
 	// 用例3 修改响应body
 	echo_proxy.AddPlugin(&echo.Plugin{
 		Match: "*.baidu.com/*",
+		// 只处理 HTML 响应，其他响应直接透传
+		Response: &echo.ResponseMatch{
+			Status:      "2xx",
+			ContentType: []string{"text/html"},
+		},
 		OnResponse: func(ctx *echo.Context) {
-			res := ctx.Res
-			if res == nil {
-				return
-			}
-			content_type := res.Header.Get("Content-Type")
-			fmt.Println(content_type)
-			if strings.Contains(content_type, "text/html") {
-				body, err := ctx.GetResponseBody()
-				if err == nil {
-					body = strings.Replace(body, "百度一下，你就知道", "Modify", -1)
-					ctx.SetResponseBody(body)
-				}
+			body, err := ctx.GetResponseBody()
+			if err == nil {
+				body = strings.Replace(body, "百度一下，你就知道", "Modify", -1)
+				ctx.SetResponseBody(body)
 			}
 		},
 	})
@@ -0,0 +1,238 @@
+package echo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Balancing strategies for Plugin.Targets
+const (
+	BalanceRoundRobin = "round_robin" // each target in turn
+	BalanceWeighted   = "weighted"    // in proportion to TargetConfig.Weight
+	BalanceHeader     = "header"      // by a hash of the Key request header
+	BalanceCookie     = "cookie"      // by a hash of the Key cookie
+)
+
+// Default passive health settings
+const (
+	defaultMaxFails    = 1
+	defaultFailTimeout = 10 * time.Second
+)
+
+// Balance chooses among the Targets of a plugin. Hash strategies send
+// requests with the same header or cookie value to the same target as long
+// as it is up, and fall back to round robin when the value is missing.
+//
+// Health is tracked passively: a connection error or a 502, 503 or 504
+// response counts as a failure, and MaxFails failures in a row take a
+// target out of rotation for FailTimeout. When every target is down, all
+// of them are tried again.
+type Balance struct {
+	Strategy    string        `yaml:"strategy"`     // see the Balance constants; round_robin by default
+	Key         string        `yaml:"key"`          // header or cookie name for the hash strategies
+	MaxFails    int           `yaml:"max_fails"`    // failures in a row that mark a target down, 1 by default
+	FailTimeout time.Duration `yaml:"fail_timeout"` // how long a target stays down, e.g. "30s"; 10s by default
+}
+
+// validate checks the strategy and its key; nil is valid
+func (b *Balance) validate() error {
+	if b == nil {
+		return nil
+	}
+	switch b.Strategy {
+	case "", BalanceRoundRobin, BalanceWeighted:
+	case BalanceHeader, BalanceCookie:
+		if b.Key == "" {
+			return fmt.Errorf("strategy %q needs a key", b.Strategy)
+		}
+	default:
+		return fmt.Errorf("unsupported strategy %q (supported: round_robin, weighted, header, cookie)", b.Strategy)
+	}
+	if b.MaxFails < 0 || b.FailTimeout < 0 {
+		return fmt.Errorf("max_fails and fail_timeout must not be negative")
+	}
+	return nil
+}
+
+// balancer is the compiled Balance of a plugin with its runtime state
+type balancer struct {
+	targets     []*TargetConfig
+	strategy    string
+	key         string
+	maxFails    int
+	failTimeout time.Duration
+
+	mu        sync.Mutex
+	next      int         // round robin position
+	current   []int       // smooth weighted round robin state
+	fails     []int       // failures in a row
+	downUntil []time.Time // out of rotation until then
+}
+
+func compileBalancer(targets []*TargetConfig, b *Balance) (*balancer, error) {
+	if b == nil {
+		b = &Balance{}
+	}
+	if err := b.validate(); err != nil {
+		return nil, fmt.Errorf("balance: %w", err)
+	}
+	for i, t := range targets {
+		if t == nil {
+			return nil, fmt.Errorf("targets[%d] is empty", i)
+		}
+		if t.Weight < 0 {
+			return nil, fmt.Errorf("targets[%d]: negative weight %d", i, t.Weight)
+		}
+	}
+	bal := &balancer{
+		targets:     targets,
+		strategy:    b.Strategy,
+		key:         b.Key,
+		maxFails:    b.MaxFails,
+		failTimeout: b.FailTimeout,
+		current:     make([]int, len(targets)),
+		fails:       make([]int, len(targets)),
+		downUntil:   make([]time.Time, len(targets)),
+	}
+	if bal.strategy == "" {
+		bal.strategy = BalanceRoundRobin
+	}
+	if bal.maxFails <= 0 {
+		bal.maxFails = defaultMaxFails
+	}
+	if bal.failTimeout <= 0 {
+		bal.failTimeout = defaultFailTimeout
+	}
+	return bal, nil
+}
+
+// pick chooses the target for r
+func (b *balancer) pick(r *http.Request) *TargetConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	up := make([]bool, len(b.targets))
+	anyUp := false
+	for i := range b.targets {
+		up[i] = !now.Before(b.downUntil[i])
+		anyUp = anyUp || up[i]
+	}
+	if !anyUp {
+		// Better to try a target that may have recovered than to fail
+		for i := range up {
+			up[i] = true
+		}
+	}
+
+	if value := b.hashValue(r); value != "" {
+		return b.targets[b.rendezvous(value, up)]
+	}
+	if b.strategy == BalanceWeighted {
+		return b.targets[b.weighted(up)]
+	}
+	for k := range b.targets {
+		i := (b.next + k) % len(b.targets)
+		if up[i] {
+			b.next = i + 1
+			return b.targets[i]
+		}
+	}
+	return b.targets[0]
+}
+
+// hashValue returns the value the hash strategies route by, or ""
+func (b *balancer) hashValue(r *http.Request) string {
+	switch b.strategy {
+	case BalanceHeader:
+		return r.Header.Get(b.key)
+	case BalanceCookie:
+		if c, err := r.Cookie(b.key); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// rendezvous returns the up target with the highest hash for value, so a
+// value keeps its target and only moves when that target goes down
+func (b *balancer) rendezvous(value string, up []bool) int {
+	best, bestScore := 0, uint64(0)
+	for i := range b.targets {
+		if !up[i] {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.Itoa(i)))
+		if score := h.Sum64(); score >= bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// weighted is the smooth weighted round robin of nginx: every target
+// gains its weight, the richest one is chosen and pays the total
+func (b *balancer) weighted(up []bool) int {
+	best, total := -1, 0
+	for i, t := range b.targets {
+		if !up[i] {
+			continue
+		}
+		weight := t.weight()
+		b.current[i] += weight
+		total += weight
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// report records the outcome of a request to t
+func (b *balancer) report(t *TargetConfig, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, target := range b.targets {
+		if target != t {
+			continue
+		}
+		if ok {
+			b.fails[i] = 0
+			return
+		}
+		b.fails[i]++
+		if b.fails[i] >= b.maxFails {
+			b.fails[i] = 0
+			b.downUntil[i] = time.Now().Add(b.failTimeout)
+			log.Printf("[Balance] %s marked down for %s", t.label(), b.failTimeout)
+		}
+		return
+	}
+}
+
+// healthyStatus reports whether a response counts as a success for
+// passive health checks
+func healthyStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return false
+	}
+	return true
+}
+
+// weight returns the weight of t, 1 when unset
+func (t *TargetConfig) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
@@ -0,0 +1,181 @@
+package echo_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+// namedTarget is an in-process target answering with its name
+func namedTarget(name string, status int) *echo.TargetConfig {
+	return &echo.TargetConfig{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, name)
+	})}
+}
+
+// balancedGet returns a function sending GETs through one HTTPHandler, so
+// the balancer keeps its state between requests
+func balancedGet(t *testing.T, plugin *echo.Plugin) func(header http.Header) string {
+	t.Helper()
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{plugin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := echo.NewHTTPHandler(loader)
+	return func(header http.Header) string {
+		r := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.HandleRequest(w, r)
+		return w.Body.String()
+	}
+}
+
+func TestBalanceStrategies(t *testing.T) {
+	weighted := namedTarget("a", http.StatusOK)
+	weighted.Weight = 3
+	cases := []struct {
+		name     string
+		targets  []*echo.TargetConfig
+		balance  *echo.Balance
+		expected string
+	}{
+		{"round robin", []*echo.TargetConfig{namedTarget("a", 200), namedTarget("b", 200), namedTarget("c", 200)}, nil, "abcabcab"},
+		{"weighted", []*echo.TargetConfig{weighted, namedTarget("b", 200)}, &echo.Balance{Strategy: echo.BalanceWeighted}, "aabaaaba"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			get := balancedGet(t, &echo.Plugin{Match: "api.example.com", Targets: c.targets, Balance: c.balance})
+			var got strings.Builder
+			for i := 0; i < len(c.expected); i++ {
+				got.WriteString(get(nil))
+			}
+			if got.String() != c.expected {
+				t.Fatalf("expected %q, got %q", c.expected, got.String())
+			}
+		})
+	}
+}
+
+func TestBalanceSticky(t *testing.T) {
+	targets := []*echo.TargetConfig{namedTarget("a", 200), namedTarget("b", 200), namedTarget("c", 200)}
+	cases := []struct {
+		name    string
+		balance *echo.Balance
+		header  func(user string) http.Header
+	}{
+		{"header", &echo.Balance{Strategy: echo.BalanceHeader, Key: "X-User"}, func(user string) http.Header {
+			return http.Header{"X-User": {user}}
+		}},
+		{"cookie", &echo.Balance{Strategy: echo.BalanceCookie, Key: "session"}, func(user string) http.Header {
+			return http.Header{"Cookie": {"theme=dark; session=" + user}}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			get := balancedGet(t, &echo.Plugin{Match: "api.example.com", Targets: targets, Balance: c.balance})
+			seen := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				user := fmt.Sprintf("user%d", i)
+				first := get(c.header(user))
+				for j := 0; j < 3; j++ {
+					if again := get(c.header(user)); again != first {
+						t.Fatalf("expected %s to stick to %s, got %s", user, first, again)
+					}
+				}
+				seen[first] = true
+			}
+			if len(seen) < 2 {
+				t.Fatalf("expected users to be spread over the targets, got %v", seen)
+			}
+		})
+	}
+}
+
+func TestBalancePassiveHealth(t *testing.T) {
+	get := balancedGet(t, &echo.Plugin{
+		Match:   "api.example.com",
+		Targets: []*echo.TargetConfig{namedTarget("down", http.StatusServiceUnavailable), namedTarget("up", 200)},
+	})
+	if got := get(nil); got != "down" {
+		t.Fatalf("expected the first request to reach the failing target, got %q", got)
+	}
+	for i := 0; i < 4; i++ {
+		if got := get(nil); got != "up" {
+			t.Fatalf("expected the failing target to be out of rotation, got %q", got)
+		}
+	}
+
+	// With every target down, they are all tried again
+	get = balancedGet(t, &echo.Plugin{
+		Match:   "api.example.com",
+		Targets: []*echo.TargetConfig{namedTarget("a", http.StatusBadGateway), namedTarget("b", http.StatusBadGateway)},
+	})
+	if got := get(nil) + get(nil) + get(nil); got != "aba" {
+		t.Fatalf("expected down targets to be retried, got %q", got)
+	}
+}
+
+func TestBalanceWebSocket(t *testing.T) {
+	// A port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	})
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{{
+		Match: "ws.example.com",
+		Targets: []*echo.TargetConfig{
+			{Protocol: "ws", Host: "127.0.0.1", Port: closedPort},
+			{Handler: backend},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &echo.WebSocketHandler{PluginLoader: loader}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleUpgrade(w, r, false)
+	}))
+	defer proxy.Close()
+
+	upgrade := func() string {
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: ws.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		status, _ := bufio.NewReader(conn).ReadString('\n')
+		return strings.TrimSpace(status)
+	}
+	if status := upgrade(); !strings.Contains(status, "502") {
+		t.Fatalf("expected the unreachable target to fail, got %q", status)
+	}
+	for i := 0; i < 3; i++ {
+		if status := upgrade(); !strings.Contains(status, "101") {
+			t.Fatalf("expected the healthy target to be used, got %q", status)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// File names used by LoadOrCreateRootCA
+const (
+	RootCACertFile = "rootCA.crt"
+	RootCAKeyFile  = "rootCA.key"
+)
+
+// DefaultCAValidity is the validity of a generated root CA
+const DefaultCAValidity = 10 * 365 * 24 * time.Hour
+
+// CAOptions configures GenerateRootCA
+type CAOptions struct {
+	// Subject of the CA. An empty CommonName becomes "Echo Root CA" followed
+	// by a random suffix, so that each generated CA can be told apart in a
+	// trust store.
+	Subject  pkix.Name
+	Validity time.Duration // default DefaultCAValidity
+	KeyType  KeyType       // default KeyECDSAP256
+}
+
+// CA is a root certificate authority with its private key
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// GenerateRootCA creates a new self-signed root CA. opts may be nil.
+func GenerateRootCA(opts *CAOptions) (*CA, error) {
+	if opts == nil {
+		opts = &CAOptions{}
+	}
+	key, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	skid := sha1.Sum(pubDER)
+
+	subject := opts.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = fmt.Sprintf("Echo Root CA %x", skid[:4])
+	}
+	if len(subject.Organization) == 0 {
+		subject.Organization = []string{"Echo"}
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = DefaultCAValidity
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          skid[:],
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: caCert, Key: key}, nil
+}
+
+// CertPEM returns the certificate in PEM form
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// CertDER returns the certificate in DER form (.cer/.der)
+func (ca *CA) CertDER() []byte {
+	return ca.Cert.Raw
+}
+
+// KeyPEM returns the private key as an unencrypted PKCS#8 PEM block
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// PKCS12 returns the certificate and key as a PKCS#12 bundle (.p12)
+// encrypted with password
+func (ca *CA) PKCS12(password string) ([]byte, error) {
+	return pkcs12.Modern.Encode(ca.Key, ca.Cert, nil, password)
+}
+
+// LoadOrCreateRootCA loads RootCACertFile and RootCAKeyFile from dir, or
+// generates a CA with opts and writes them there if neither exists yet.
+// created reports whether a new CA was generated.
+func LoadOrCreateRootCA(dir string, opts *CAOptions) (ca *CA, created bool, err error) {
+	certPath := filepath.Join(dir, RootCACertFile)
+	keyPath := filepath.Join(dir, RootCAKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	switch {
+	case certErr == nil && keyErr == nil:
+		caCert, caKey, err := LoadRootCA(certPEM, keyPEM)
+		if err != nil {
+			return nil, false, err
+		}
+		signer, ok := caKey.(crypto.Signer)
+		if !ok {
+			return nil, false, fmt.Errorf("%s: unsupported key type %T", keyPath, caKey)
+		}
+		return &CA{Cert: caCert, Key: signer}, false, nil
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+	case certErr != nil && !errors.Is(certErr, os.ErrNotExist):
+		return nil, false, certErr
+	case keyErr != nil && !errors.Is(keyErr, os.ErrNotExist):
+		return nil, false, keyErr
+	default:
+		// Never overwrite half of an existing CA
+		return nil, false, fmt.Errorf("%s: found only one of %s and %s", dir, RootCACertFile, RootCAKeyFile)
+	}
+
+	ca, err = GenerateRootCA(opts)
+	if err != nil {
+		return nil, false, err
+	}
+	keyPEM, err = ca.KeyPEM()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, err
+	}
+	if err := writeFileAtomic(keyPath, keyPEM, 0o600); err != nil {
+		return nil, false, err
+	}
+	if err := writeFileAtomic(certPath, ca.CertPEM(), 0o644); err != nil {
+		return nil, false, err
+	}
+	return ca, true, nil
+}
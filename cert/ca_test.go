@@ -0,0 +1,81 @@
+package cert_test
+
+import (
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo/cert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestGenerateRootCA(t *testing.T) {
+	ca, err := cert.GenerateRootCA(&cert.CAOptions{
+		Subject:  pkix.Name{CommonName: "Team CA", Organization: []string{"Team"}},
+		Validity: 48 * time.Hour,
+		KeyType:  cert.KeyRSA2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Cert.Subject.CommonName != "Team CA" || !ca.Cert.IsCA {
+		t.Fatalf("unexpected certificate %v", ca.Cert.Subject)
+	}
+	if _, ok := ca.Key.(*rsa.PrivateKey); !ok {
+		t.Fatalf("expected an RSA key, got %T", ca.Key)
+	}
+	if ca.Cert.NotAfter.After(time.Now().Add(49 * time.Hour)) {
+		t.Fatalf("expected a 48h validity, got %v", ca.Cert.NotAfter)
+	}
+
+	// Each export loads back
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cert.LoadRootCA(ca.CertPEM(), keyPEM); err != nil {
+		t.Fatalf("PEM: %v", err)
+	}
+	if loaded, _, err := cert.LoadRootCA(ca.CertDER(), keyPEM); err != nil || !loaded.Equal(ca.Cert) {
+		t.Fatalf("DER: %v", err)
+	}
+	p12, err := ca.PKCS12("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, c, _, err := pkcs12.DecodeChain(p12, "secret"); err != nil || !c.Equal(ca.Cert) {
+		t.Fatalf("PKCS#12: %v", err)
+	}
+
+	// The default subject is unique per CA
+	a, _ := cert.GenerateRootCA(nil)
+	b, _ := cert.GenerateRootCA(nil)
+	if !strings.HasPrefix(a.Cert.Subject.CommonName, "Echo Root CA ") || a.Cert.Subject.CommonName == b.Cert.Subject.CommonName {
+		t.Fatalf("unexpected default names %q and %q", a.Cert.Subject.CommonName, b.Cert.Subject.CommonName)
+	}
+}
+
+func TestLoadOrCreateRootCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "echo")
+	ca, created, err := cert.LoadOrCreateRootCA(dir, nil)
+	if err != nil || !created {
+		t.Fatalf("expected a new CA: %v", err)
+	}
+	loaded, created, err := cert.LoadOrCreateRootCA(dir, nil)
+	if err != nil || created {
+		t.Fatalf("expected the saved CA: %v", err)
+	}
+	if !loaded.Cert.Equal(ca.Cert) {
+		t.Fatalf("loaded another CA")
+	}
+
+	// Half a CA is an error rather than being overwritten
+	os.Remove(filepath.Join(dir, cert.RootCAKeyFile))
+	if _, _, err := cert.LoadOrCreateRootCA(dir, nil); err == nil {
+		t.Fatalf("expected an error for a missing key")
+	}
+}
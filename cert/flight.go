@@ -0,0 +1,43 @@
+package cert
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// flightGroup makes concurrent callers with the same key share one call
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	cert *tls.Certificate
+	err  error
+}
+
+// do runs fn once for all callers that arrive while it is running for key
+func (g *flightGroup) do(key string, fn func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.cert, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.cert, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.cert, c.err
+}
@@ -0,0 +1,83 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+)
+
+// KeyType is a private key algorithm for issued certificates
+type KeyType string
+
+const (
+	KeyECDSAP256 KeyType = "ecdsa-p256" // default: fast to generate and to sign with
+	KeyECDSAP384 KeyType = "ecdsa-p384"
+	KeyRSA2048   KeyType = "rsa-2048"
+	KeyRSA4096   KeyType = "rsa-4096"
+	KeyEd25519   KeyType = "ed25519" // TLS 1.3 only, and not accepted by every client
+)
+
+// Valid reports whether t is one of the key types above or ""
+func (t KeyType) Valid() bool {
+	switch t {
+	case "", KeyECDSAP256, KeyECDSAP384, KeyRSA2048, KeyRSA4096, KeyEd25519:
+		return true
+	}
+	return false
+}
+
+// GenerateKey returns a new private key of type t ("" is KeyECDSAP256)
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case "", KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", t)
+	}
+}
+
+// keyTypeOf returns the KeyType of key, or "" if it is none of them
+func keyTypeOf(key crypto.Signer) KeyType {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256
+		case elliptic.P384():
+			return KeyECDSAP384
+		}
+	case *rsa.PrivateKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return KeyRSA2048
+		case 4096:
+			return KeyRSA4096
+		}
+	case ed25519.PrivateKey:
+		return KeyEd25519
+	}
+	return ""
+}
+
+// leafKeyUsage is the key usage for a leaf certificate with key: key
+// encipherment only applies to RSA key exchange
+func leafKeyUsage(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
@@ -1,43 +1,178 @@
 package cert
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
-// LoadRootCA loads the root CA certificate and private key from PEM files
+// LoadRootCA loads the root CA certificate and private key. See
+// LoadRootCAWithPassword for the accepted forms.
 func LoadRootCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.PrivateKey, error) {
-	// Load certificate
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return nil, nil, fmt.Errorf("failed to decode certificate PEM")
+	return LoadRootCAWithPassword(certPEM, keyPEM, "")
+}
+
+// LoadRootCAWithPassword loads the root CA certificate and private key.
+// See LoadCA for the accepted forms; certificates after the first are
+// ignored.
+func LoadRootCAWithPassword(certData, keyData []byte, password string) (*x509.Certificate, crypto.PrivateKey, error) {
+	cert, key, _, err := LoadCA(certData, keyData, password)
+	return cert, key, err
+}
+
+// LoadCA loads a CA certificate, its private key and the certificates
+// above it, for Manager.SetCA. The certificates may be PEM or DER (.cer);
+// the first one is the CA and the rest its chain. The key may be PEM or
+// DER in PKCS#1, SEC1 (EC) or PKCS#8 form, or encrypted PEM (PKCS#8
+// "ENCRYPTED PRIVATE KEY" or a legacy "Proc-Type: 4,ENCRYPTED" block)
+// decrypted with password. If keyData is empty, certData is a PKCS#12
+// bundle protected by password or a PEM file holding both the
+// certificates and the key.
+func LoadCA(certData, keyData []byte, password string) (*x509.Certificate, crypto.PrivateKey, []*x509.Certificate, error) {
+	if len(keyData) == 0 {
+		if !bytes.Contains(certData, []byte("-----BEGIN")) {
+			return loadPKCS12(certData, password)
+		}
+		keyData = certData
+	}
+
+	certs, err := parseCertificates(certData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	privateKey, err := parsePrivateKey(keyData, password)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	return certs[0], privateKey, certs[1:], nil
+}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
+func loadPKCS12(data []byte, password string) (*x509.Certificate, crypto.PrivateKey, []*x509.Certificate, error) {
+	privateKey, cert, chain, err := pkcs12.DecodeChain(data, password)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+		return nil, nil, nil, fmt.Errorf("failed to decode PKCS#12 bundle: %w", err)
 	}
+	return cert, privateKey, chain, nil
+}
 
-	keyBlock, _ := pem.Decode(keyPEM)
-	if keyBlock == nil {
-		return nil, nil, fmt.Errorf("failed to decode private key PEM")
+// parseCertificates parses the certificates in data, PEM or DER
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificate found")
+		}
+		return certs, nil
 	}
 
-	var privateKey crypto.PrivateKey
-	switch keyBlock.Type {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	return certs, nil
+}
+
+// parsePrivateKey parses the first private key in data, PEM or DER
+func parsePrivateKey(data []byte, password string) (crypto.PrivateKey, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return parseKeyDER(data)
+	}
+
+	// Skips certificates and the EC PARAMETERS block "openssl ecparam
+	// -genkey" writes before the key
+	block := findPEM(data, func(b *pem.Block) bool { return strings.HasSuffix(b.Type, "PRIVATE KEY") })
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key PEM")
+	}
+	der := block.Bytes
+	// Legacy PEM encryption is weak and deprecated, but it is still what
+	// "openssl genrsa -aes256" and many CA tools write
+	if x509.IsEncryptedPEMBlock(block) {
+		if password == "" {
+			return nil, fmt.Errorf("private key is encrypted, a password is required")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+		}
+	}
+
+	var (
+		privateKey crypto.PrivateKey
+		err        error
+	)
+	switch block.Type {
 	case "RSA PRIVATE KEY":
-		privateKey, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+		privateKey, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(der)
 	case "PRIVATE KEY":
-		privateKey, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		privateKey, err = x509.ParsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		if password == "" {
+			return nil, fmt.Errorf("private key is encrypted, a password is required")
+		}
+		if der, err = decryptPKCS8(der, password); err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+		}
+		privateKey, err = x509.ParsePKCS8PrivateKey(der)
 	default:
-		return nil, nil, fmt.Errorf("unsupported key type: %s", keyBlock.Type)
+		return nil, fmt.Errorf("unsupported key type: %s", block.Type)
 	}
-
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
 	}
+	return privateKey, nil
+}
 
-	return cert, privateKey, nil
+// parseKeyDER tries each DER private key encoding in turn
+func parseKeyDER(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("failed to parse private key: not PKCS#8, PKCS#1 or SEC1 DER")
+}
+
+// findPEM returns the first PEM block in data accepted by match
+func findPEM(data []byte, match func(*pem.Block) bool) *pem.Block {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if match(block) {
+			return block
+		}
+	}
 }
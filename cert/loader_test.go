@@ -0,0 +1,170 @@
+package cert_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo/cert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testCA returns a self-signed CA certificate for key
+func testCA(t *testing.T, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Echo Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func pemBlock(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+func TestLoadRootCAKeyFormats(t *testing.T) {
+	ecKey, _ := cert.GenerateKey(cert.KeyECDSAP256)
+	rsaKey, _ := cert.GenerateKey(cert.KeyRSA2048)
+	ecCA, rsaCA := testCA(t, ecKey), testCA(t, rsaKey)
+	ecCertPEM := pemBlock("CERTIFICATE", ecCA.Raw)
+
+	sec1, _ := x509.MarshalECPrivateKey(ecKey.(*ecdsa.PrivateKey))
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	pkcs1 := x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey))
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", sec1, []byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := pkcs12.Modern.Encode(ecKey, ecCA, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		cert, key []byte
+		password  string
+		ca        *x509.Certificate
+	}{
+		{"SEC1 PEM", ecCertPEM, pemBlock("EC PRIVATE KEY", sec1), "", ecCA},
+		{"PKCS#8 PEM", ecCertPEM, pemBlock("PRIVATE KEY", pkcs8), "", ecCA},
+		{"PKCS#1 PEM", pemBlock("CERTIFICATE", rsaCA.Raw), pemBlock("RSA PRIVATE KEY", pkcs1), "", rsaCA},
+		{"legacy encrypted PEM", ecCertPEM, pem.EncodeToMemory(legacy), "secret", ecCA},
+		{"DER", ecCA.Raw, sec1, "", ecCA},
+		{"combined PEM", append(pemBlock("PRIVATE KEY", pkcs8), ecCertPEM...), nil, "", ecCA},
+		{"PKCS#12", bundle, nil, "secret", ecCA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, key, err := cert.LoadRootCAWithPassword(tt.cert, tt.key, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ca.Equal(tt.ca) {
+				t.Fatalf("loaded the wrong certificate")
+			}
+			pub := key.(crypto.Signer).Public().(interface{ Equal(crypto.PublicKey) bool })
+			if !pub.Equal(tt.ca.PublicKey) {
+				t.Fatalf("loaded a key that does not match the certificate")
+			}
+		})
+	}
+
+	if _, _, err := cert.LoadRootCA(ecCertPEM, pem.EncodeToMemory(legacy)); err == nil {
+		t.Fatalf("expected an error without a password")
+	}
+}
+
+func TestLoadRootCAEncryptedPKCS8(t *testing.T) {
+	// Written by: openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -passout pass:secret
+	certPEM, err := os.ReadFile("testdata/ca.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := os.ReadFile("testdata/ca-encrypted.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cert.LoadRootCAWithPassword(certPEM, keyPEM, "wrong"); err == nil {
+		t.Fatalf("expected an error with a wrong password")
+	}
+	if _, _, err := cert.LoadRootCAWithPassword(certPEM, keyPEM, "secret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRootCAECParameters(t *testing.T) {
+	// Written by: openssl ecparam -name prime256v1 -genkey, which puts an
+	// EC PARAMETERS block before the key
+	certPEM, err := os.ReadFile("testdata/ca-ecparam.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := os.ReadFile("testdata/ca-ecparam.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cert.LoadRootCA(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	// The same key after its certificate, in one file
+	if _, _, err := cert.LoadRootCA(append(certPEM, keyPEM...), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, kt := range []cert.KeyType{cert.KeyECDSAP256, cert.KeyRSA2048, cert.KeyEd25519} {
+		t.Run(string(kt), func(t *testing.T) {
+			m := testManager(t)
+			if err := m.SetKeyType(kt); err != nil {
+				t.Fatal(err)
+			}
+			c, err := m.GetCertificate("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch c.PrivateKey.(type) {
+			case *ecdsa.PrivateKey:
+				if kt != cert.KeyECDSAP256 {
+					t.Fatalf("expected a %s key, got ECDSA", kt)
+				}
+			case *rsa.PrivateKey:
+				if kt != cert.KeyRSA2048 {
+					t.Fatalf("expected a %s key, got RSA", kt)
+				}
+			case ed25519.PrivateKey:
+				if kt != cert.KeyEd25519 {
+					t.Fatalf("expected a %s key, got Ed25519", kt)
+				}
+			}
+			encipher := c.Leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0
+			if encipher != (kt == cert.KeyRSA2048) {
+				t.Fatalf("unexpected key usage %v for %s", c.Leaf.KeyUsage, kt)
+			}
+		})
+	}
+}
@@ -1,66 +1,311 @@
 package cert
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/pem"
 	"fmt"
 	"math/big"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Manager handles certificate generation and caching
 type Manager struct {
-	caCert       *x509.Certificate
-	caKey        crypto.PrivateKey
-	certCache    sync.Map // map[string]*tls.Certificate
-	serverKey    *rsa.PrivateKey
-	serverKeyPEM []byte
+	mu sync.RWMutex
+	ca *issuer // replaced by SetCA
+
+	store     CertStore
+	serverKey crypto.Signer // shared by all issued certificates
+	flight    flightGroup
+	wildcard  bool
+
+	// mimicDial is set when certificates copy the real server's certificate
+	mimicDial   func(addr string) (net.Conn, error)
+	mimicIssued sync.Map // store key -> time.Time this Manager issued it
+
+	template TemplateFunc // guarded by mu
+	signed   bool         // guarded by mu; set by the first certificate issued
 }
 
+// TemplateFunc customises the certificate issued for hostname. template
+// holds the defaults: subject, validity, SANs and key usages, or the
+// fields copied from the real server with EnableMimic. The function may
+// change any field, e.g. NotAfter, DNSNames, KeyUsage, ExtKeyUsage,
+// OCSPServer, IssuingCertificateURL, CRLDistributionPoints or Subject.
+// SerialNumber may be replaced; the public key and issuer are always
+// the Manager's. An error fails the handshake.
+type TemplateFunc func(hostname string, template *x509.Certificate) error
+
 // NewManager creates a new certificate manager
 func NewManager(caCert *x509.Certificate, caKey crypto.PrivateKey) (*Manager, error) {
-	// Generate a single RSA key pair for all certificates (for performance)
-	serverKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	// Generate a single key pair for all certificates (for performance)
+	serverKey, err := GenerateKey(KeyECDSAP256)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate server key: %w", err)
 	}
 
-	serverKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(serverKey),
-	})
-
 	return &Manager{
-		caCert:       caCert,
-		caKey:        caKey,
-		serverKey:    serverKey,
-		serverKeyPEM: serverKeyPEM,
+		ca:        newIssuer(caCert, caKey, nil),
+		store:     NewMemoryStore(DefaultStoreSize),
+		serverKey: serverKey,
 	}, nil
 }
 
+// issuer is the CA that signs certificates
+type issuer struct {
+	cert  *x509.Certificate
+	key   crypto.PrivateKey
+	chain [][]byte          // sent after each leaf: intermediates, not the root
+	root  *x509.Certificate // what clients have to trust
+}
+
+func newIssuer(caCert *x509.Certificate, caKey crypto.PrivateKey, chain []*x509.Certificate) *issuer {
+	is := &issuer{cert: caCert, key: caKey, root: caCert}
+	if !selfSigned(caCert) {
+		is.chain = append(is.chain, caCert.Raw)
+	}
+	for _, c := range chain {
+		is.root = c
+		if !selfSigned(c) {
+			is.chain = append(is.chain, c.Raw)
+		}
+	}
+	return is
+}
+
+func selfSigned(c *x509.Certificate) bool {
+	return bytes.Equal(c.RawIssuer, c.RawSubject) && c.CheckSignatureFrom(c) == nil
+}
+
+// issuer returns the current CA
+func (m *Manager) issuer() *issuer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ca
+}
+
+// SetCA replaces the CA that signs new certificates. caCert may be an
+// intermediate CA: chain lists the certificates above it, in order, up to
+// and optionally including the root. Intermediates are sent after each
+// leaf in handshakes. The store is flushed if it implements Flusher, and
+// certificates from the previous CA are reissued on next use either way.
+// It is safe to call while the Manager is in use.
+func (m *Manager) SetCA(caCert *x509.Certificate, caKey crypto.PrivateKey, chain ...*x509.Certificate) error {
+	if !caCert.IsCA {
+		return fmt.Errorf("certificate %q is not a CA", caCert.Subject.CommonName)
+	}
+	signer, ok := caKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported CA key type %T", caKey)
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(caCert.PublicKey) {
+		return fmt.Errorf("CA key does not match certificate %q", caCert.Subject.CommonName)
+	}
+	child := caCert
+	for _, c := range chain {
+		if err := child.CheckSignatureFrom(c); err != nil {
+			return fmt.Errorf("certificate %q is not signed by %q: %w", child.Subject.CommonName, c.Subject.CommonName, err)
+		}
+		child = c
+	}
+
+	m.mu.Lock()
+	m.ca = newIssuer(caCert, caKey, chain)
+	m.mu.Unlock()
+	if f, ok := m.store.(Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// SetKeyType replaces the key of new certificates with a fresh key of type
+// t. Call it before SetStore and before the Manager is used.
+func (m *Manager) SetKeyType(t KeyType) error {
+	if keyTypeOf(m.serverKey) == t {
+		return nil
+	}
+	key, err := GenerateKey(t)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %w", err)
+	}
+	m.serverKey = key
+	return nil
+}
+
+// SetStore replaces the in-memory store. If store is also a KeyStore, the
+// key it holds is used for new certificates, or the current key is saved
+// to it when it has none or a key of another type. Call it before the
+// Manager is used.
+func (m *Manager) SetStore(store CertStore) error {
+	if ks, ok := store.(KeyStore); ok {
+		key, err := ks.LoadKey()
+		if err != nil {
+			return fmt.Errorf("failed to load server key: %w", err)
+		}
+		if key == nil || keyTypeOf(key) != keyTypeOf(m.serverKey) {
+			if err := ks.SaveKey(m.serverKey); err != nil {
+				return fmt.Errorf("failed to save server key: %w", err)
+			}
+		} else {
+			m.serverKey = key
+		}
+	}
+	m.store = store
+	return nil
+}
+
 // GetCertificate returns a certificate for the given hostname, generating it if necessary
 func (m *Manager) GetCertificate(hostname string) (*tls.Certificate, error) {
-	// Check cache
-	if cached, ok := m.certCache.Load(hostname); ok {
-		return cached.(*tls.Certificate), nil
+	if m.wildcard {
+		if name, ok := wildcardName(hostname); ok {
+			hostname = name
+		}
 	}
+	return m.getOrIssue(hostname, m.current, func() (*tls.Certificate, error) {
+		return m.generateCert(hostname)
+	})
+}
 
-	// Generate new certificate
-	cert, err := m.generateCert(hostname)
-	if err != nil {
-		return nil, err
+// EnableWildcard makes GetCertificate issue one "*.parent" certificate for
+// all hosts directly under the same parent domain instead of one per host.
+// Call it before the Manager is used.
+func (m *Manager) EnableWildcard() {
+	m.wildcard = true
+}
+
+// Prewarm issues certificates for hosts in the background, a few at a
+// time, so the first connection to them does not wait for one
+func (m *Manager) Prewarm(hosts []string) {
+	const workers = 4
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, host := range hosts {
+			queue <- host
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for host := range queue {
+				m.GetCertificate(host)
+			}
+		}()
+	}
+}
+
+// getOrIssue returns the stored certificate for key, or issues and stores
+// a new one when there is none or current rejects it. Concurrent misses for
+// one key share a single issue call.
+func (m *Manager) getOrIssue(key string, current func(*x509.Certificate) bool, issue func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cached, ok := m.store.Get(key); ok && current(cached.Leaf) {
+		return cached, nil
+	}
+	return m.flight.do(key, func() (*tls.Certificate, error) {
+		// Another caller may have finished issuing it meanwhile
+		if cached, ok := m.store.Get(key); ok && current(cached.Leaf) {
+			return cached, nil
+		}
+		cert, err := issue()
+		if err != nil {
+			return nil, err
+		}
+		// A store that fails to persist still serves the certificate
+		m.store.Put(key, cert)
+		return cert, nil
+	})
+}
+
+// secondLevelLabels are common second-level labels under country code
+// domains, such as co.uk, that a wildcard must not sit directly under
+var secondLevelLabels = map[string]bool{
+	"co": true, "com": true, "net": true, "org": true, "gov": true,
+	"edu": true, "ac": true, "ne": true, "or": true, "go": true,
+}
+
+// wildcardName returns "*.parent" for a hostname with at least three labels,
+// unless parent looks like a public suffix such as co.uk
+func wildcardName(hostname string) (string, bool) {
+	if net.ParseIP(hostname) != nil || strings.HasPrefix(hostname, "*.") {
+		return "", false
+	}
+	labels := strings.Split(strings.TrimSuffix(hostname, "."), ".")
+	if len(labels) < 3 {
+		return "", false
+	}
+	parent := labels[1:]
+	if len(parent) == 2 && len(parent[1]) == 2 && secondLevelLabels[parent[0]] {
+		return "", false
+	}
+	return "*." + strings.Join(parent, "."), true
+}
+
+// current reports whether leaf was issued by the CA for the current key and
+// is not yet due for renewal, which happens in the last third of its
+// lifetime (at most 30 days before NotAfter)
+func (m *Manager) current(leaf *x509.Certificate) bool {
+	if !m.signedByIssuer(leaf) {
+		return false
+	}
+	renewBefore := leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	if renewBefore > 30*24*time.Hour {
+		renewBefore = 30 * 24 * time.Hour
+	}
+	return time.Now().Before(leaf.NotAfter.Add(-renewBefore))
+}
+
+// mimicCurrent reports whether the mimicked certificate leaf stored under
+// key was issued by this Manager less than mimicTTL ago. Its validity is
+// copied from the server and may be long expired, so it says nothing about
+// when it was issued; one issued before a restart is issued again.
+func (m *Manager) mimicCurrent(key string, leaf *x509.Certificate) bool {
+	issued, ok := m.mimicIssued.Load(key)
+	return ok && time.Since(issued.(time.Time)) < mimicTTL && m.signedByIssuer(leaf)
+}
+
+// signedByIssuer reports whether leaf was issued by the current CA for the
+// current key
+func (m *Manager) signedByIssuer(leaf *x509.Certificate) bool {
+	ca := m.issuer().cert
+	if leaf == nil || !bytes.Equal(leaf.RawIssuer, ca.RawSubject) {
+		return false
+	}
+	if pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(m.serverKey.Public()) {
+		return false
+	}
+	return len(ca.SubjectKeyId) == 0 || bytes.Equal(leaf.AuthorityKeyId, ca.SubjectKeyId)
+}
+
+// CACert returns the CA certificate that signs issued certificates
+func (m *Manager) CACert() *x509.Certificate {
+	return m.issuer().cert
+}
+
+// SetTemplate installs fn to customise new certificates (nil restores the
+// defaults). Installed before the Manager issues anything, certificates
+// already in the store are kept, so a persistent store survives restarts.
+// Once it has issued certificates, the store is flushed if it implements
+// Flusher, so that every host gets a certificate built with fn. It is safe
+// to call while the Manager is in use.
+func (m *Manager) SetTemplate(fn TemplateFunc) {
+	m.mu.Lock()
+	m.template = fn
+	signed := m.signed
+	m.mu.Unlock()
+	if f, ok := m.store.(Flusher); ok && signed {
+		f.Flush()
 	}
+}
 
-	// Cache it
-	m.certCache.Store(hostname, cert)
-	return cert, nil
+// RootCert returns the certificate clients have to trust: the last one of
+// the chain given to SetCA, or the signing CA itself
+func (m *Manager) RootCert() *x509.Certificate {
+	return m.issuer().root
 }
 
 // GetCertificateFunc returns a function suitable for tls.Config.GetCertificate
@@ -70,12 +315,137 @@ func (m *Manager) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certific
 	}
 }
 
+// GetCertificateFuncFor is GetCertificateFunc for a connection to
+// host:port. Clients that send no SNI get a certificate for host, which may
+// be an IP address. With EnableMimic the real server at host:port is asked
+// for its certificate first.
+func (m *Manager) GetCertificateFuncFor(host, port string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := hello.ServerName
+		if name == "" {
+			name = host
+		}
+		if m.mimicDial == nil {
+			return m.GetCertificate(name)
+		}
+		return m.getMimicCertificate(name, hello.ServerName, net.JoinHostPort(host, port))
+	}
+}
+
+// mimicTTL is how long a mimicked certificate is served before the real
+// server is asked again
+const mimicTTL = 24 * time.Hour
+
+// EnableMimic makes certificates issued by GetCertificateFuncFor copy the
+// subject, SANs and validity window of the real server's certificate, so
+// clients that check SAN lists see what they expect. dial connects to the
+// server (nil dials directly); a server that cannot be reached gets a plain
+// certificate. Mimicked certificates are issued again after a day, however
+// long the copied validity. Call it before the Manager is used.
+func (m *Manager) EnableMimic(dial func(addr string) (net.Conn, error)) {
+	if dial == nil {
+		dial = func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, 10*time.Second)
+		}
+	}
+	m.mimicDial = dial
+}
+
+// getMimicCertificate returns a certificate for name shaped like the one
+// the server at addr presents for sni
+func (m *Manager) getMimicCertificate(name, sni, addr string) (*tls.Certificate, error) {
+	key := name + "@" + addr
+	current := func(leaf *x509.Certificate) bool { return m.mimicCurrent(key, leaf) }
+	return m.getOrIssue(key, current, func() (*tls.Certificate, error) {
+		cert, err := m.issueMimic(name, sni, addr)
+		if err == nil {
+			m.mimicIssued.Store(key, time.Now())
+		}
+		return cert, err
+	})
+}
+
+// issueMimic issues a certificate for name shaped like the one the server
+// at addr presents for sni
+func (m *Manager) issueMimic(name, sni, addr string) (*tls.Certificate, error) {
+	upstream, err := m.fetchUpstreamCert(sni, addr)
+	if err == nil {
+		if cert, err := m.mimicCert(name, upstream); err == nil {
+			return cert, nil
+		}
+	}
+	// Unreachable servers still get a usable certificate
+	return m.generateCert(name)
+}
+
+// fetchUpstreamCert returns the leaf certificate the server at addr presents
+func (m *Manager) fetchUpstreamCert(sni, addr string) (*x509.Certificate, error) {
+	conn, err := m.mimicDial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true, // only the certificate's shape is used
+	})
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s sent no certificate", addr)
+	}
+	return certs[0], nil
+}
+
+// mimicCert issues a certificate with the subject, SANs and validity of
+// upstream, adding name when upstream does not cover it
+func (m *Manager) mimicCert(name string, upstream *x509.Certificate) (*tls.Certificate, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	subject := upstream.Subject
+	subject.Names = nil
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+		KeyUsage:              leafKeyUsage(m.serverKey),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              upstream.DNSNames,
+		IPAddresses:           upstream.IPAddresses,
+		URIs:                  upstream.URIs,
+		EmailAddresses:        upstream.EmailAddresses,
+	}
+	if upstream.VerifyHostname(name) != nil {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	return m.sign(name, template)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serialNumber, nil
+}
+
 // generateCert generates a new certificate for the given hostname
 func (m *Manager) generateCert(hostname string) (*tls.Certificate, error) {
 	// Create certificate template
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := newSerialNumber()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+		return nil, err
 	}
 
 	template := &x509.Certificate{
@@ -87,7 +457,7 @@ func (m *Manager) generateCert(hostname string) (*tls.Certificate, error) {
 		},
 		NotBefore:             time.Now().Add(-24 * time.Hour),
 		NotAfter:              time.Now().Add(90 * 24 * time.Hour), // 90 days instead of 1 year
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              leafKeyUsage(m.serverKey),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 		IsCA:                  false,
@@ -97,27 +467,41 @@ func (m *Manager) generateCert(hostname string) (*tls.Certificate, error) {
 	// Add SAN (Subject Alternative Name)
 	if ip := net.ParseIP(hostname); ip != nil {
 		template.IPAddresses = []net.IP{ip}
+		template.DNSNames = nil
+	} else if parent := strings.TrimPrefix(hostname, "*."); parent != hostname {
+		// A wildcard does not cover its parent, so name both
+		template.DNSNames = []string{hostname, parent}
 	} else {
 		template.DNSNames = []string{hostname}
 	}
 
-	// Sign the certificate with CA
-	certDER, err := x509.CreateCertificate(rand.Reader, template, m.caCert, &m.serverKey.PublicKey, m.caKey)
+	return m.sign(hostname, template)
+}
+
+// sign issues template for hostname with the shared server key, signed by
+// the CA and followed by its chain
+func (m *Manager) sign(hostname string, template *x509.Certificate) (*tls.Certificate, error) {
+	m.mu.Lock()
+	ca, customise := m.ca, m.template
+	m.signed = true
+	m.mu.Unlock()
+	if customise != nil {
+		if err := customise(hostname, template); err != nil {
+			return nil, fmt.Errorf("certificate template for %s: %w", hostname, err)
+		}
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.cert, m.serverKey.Public(), ca.key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create certificate: %w", err)
 	}
-
-	// Encode certificate to PEM
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certDER,
-	})
-
-	// Create tls.Certificate
-	tlsCert, err := tls.X509KeyPair(certPEM, m.serverKeyPEM)
+	leaf, err := x509.ParseCertificate(certDER)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create TLS certificate: %w", err)
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
 	}
 
-	return &tlsCert, nil
+	return &tls.Certificate{
+		Certificate: append([][]byte{certDER}, ca.chain...),
+		PrivateKey:  m.serverKey,
+		Leaf:        leaf,
+	}, nil
 }
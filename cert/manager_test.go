@@ -0,0 +1,261 @@
+package cert_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo/cert"
+)
+
+func TestGetCertificateIssuesOncePerHost(t *testing.T) {
+	m := testManager(t)
+	const n = 30
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := make(map[interface{}]bool)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := m.GetCertificate("burst.example.com")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			seen[c] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 1 {
+		t.Fatalf("expected one certificate for %d concurrent calls, got %d", n, len(seen))
+	}
+}
+
+func TestWildcardCertificates(t *testing.T) {
+	m := testManager(t)
+	m.EnableWildcard()
+
+	cases := []struct {
+		host     string
+		expected []string
+	}{
+		{"a.example.com", []string{"*.example.com", "example.com"}},
+		{"b.example.com", []string{"*.example.com", "example.com"}},
+		{"example.com", []string{"example.com"}},
+		{"example.co.uk", []string{"example.co.uk"}},
+		{"www.example.co.uk", []string{"*.example.co.uk", "example.co.uk"}},
+	}
+	for _, c := range cases {
+		cert, err := m.GetCertificate(c.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cert.Leaf.DNSNames, c.expected) {
+			t.Fatalf("%s: expected %v, got %v", c.host, c.expected, cert.Leaf.DNSNames)
+		}
+		if err := cert.Leaf.VerifyHostname(c.host); err != nil {
+			t.Fatalf("%s: %v", c.host, err)
+		}
+	}
+	a, _ := m.GetCertificate("a.example.com")
+	b, _ := m.GetCertificate("b.example.com")
+	if a != b {
+		t.Fatalf("expected hosts under one parent to share a certificate")
+	}
+}
+
+// testIntermediate returns an intermediate CA signed by root
+func testIntermediate(t *testing.T, root *cert.CA) *cert.CA {
+	t.Helper()
+	key, err := cert.GenerateKey(cert.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Echo Test Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root.Cert, key.Public(), root.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert.CA{Cert: c, Key: key}
+}
+
+func TestSetCA(t *testing.T) {
+	m := testManager(t)
+	store := cert.NewMemoryStore(0)
+	m.SetStore(store)
+	before, err := m.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := cert.GenerateRootCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate := testIntermediate(t, root)
+	other, _ := cert.GenerateRootCA(nil)
+	if err := m.SetCA(intermediate.Cert, intermediate.Key, other.Cert); err == nil {
+		t.Fatalf("expected an error for a chain that does not link up")
+	}
+	if err := m.SetCA(intermediate.Cert, other.Key, root.Cert); err == nil {
+		t.Fatalf("expected an error for a key that does not match")
+	}
+	if err := m.SetCA(intermediate.Cert, intermediate.Key, root.Cert); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("expected the store to be flushed")
+	}
+	if !m.RootCert().Equal(root.Cert) || !m.CACert().Equal(intermediate.Cert) {
+		t.Fatalf("unexpected CA certificates")
+	}
+
+	after, err := m.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before || after.Leaf.Issuer.CommonName != "Echo Test Intermediate" {
+		t.Fatalf("expected a certificate from the intermediate, got one from %q", after.Leaf.Issuer.CommonName)
+	}
+	// The intermediate is sent, the root is not
+	if len(after.Certificate) != 2 || !bytes.Equal(after.Certificate[1], intermediate.Cert.Raw) {
+		t.Fatalf("expected leaf and intermediate, got %d certificates", len(after.Certificate))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Cert)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate.Cert)
+	if _, err := after.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetTemplate(t *testing.T) {
+	m := testManager(t)
+	store := cert.NewMemoryStore(0)
+	m.SetStore(store)
+	if c, _ := m.GetCertificate("api.example.com"); c.Leaf.Subject.Organization[0] != "Echo Proxy" {
+		t.Fatalf("unexpected default subject %v", c.Leaf.Subject)
+	}
+
+	notAfter := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	m.SetTemplate(func(hostname string, tmpl *x509.Certificate) error {
+		if hostname == "denied.example.com" {
+			return errors.New("no certificate for you")
+		}
+		tmpl.Subject = pkix.Name{CommonName: hostname, Organization: []string{"Acme"}}
+		tmpl.NotAfter = notAfter
+		tmpl.DNSNames = append(tmpl.DNSNames, "alt."+hostname)
+		tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+		tmpl.IssuingCertificateURL = []string{"http://ca.example.com/ca.cer"}
+		tmpl.CRLDistributionPoints = []string{"http://ca.example.com/ca.crl"}
+		return nil
+	})
+	if store.Len() != 0 {
+		t.Fatalf("expected the store to be flushed")
+	}
+
+	c, err := m.GetCertificate("api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := c.Leaf
+	if leaf.Subject.Organization[0] != "Acme" || !leaf.NotAfter.Equal(notAfter) {
+		t.Fatalf("template not applied: %v until %v", leaf.Subject, leaf.NotAfter)
+	}
+	if !reflect.DeepEqual(leaf.DNSNames, []string{"api.example.com", "alt.api.example.com"}) {
+		t.Fatalf("unexpected SANs %v", leaf.DNSNames)
+	}
+	if len(leaf.ExtKeyUsage) != 2 || len(leaf.IssuingCertificateURL) != 1 || len(leaf.CRLDistributionPoints) != 1 {
+		t.Fatalf("missing extensions")
+	}
+	if _, err := m.GetCertificate("denied.example.com"); err == nil {
+		t.Fatalf("expected the template error")
+	}
+}
+
+func TestMimicExpiredUpstream(t *testing.T) {
+	// A server whose certificate expired long ago
+	key, err := cert.GenerateKey(cert.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "expired.example.com"},
+		DNSNames:     []string{"expired.example.com"},
+		NotBefore:    time.Now().Add(-2 * 365 * 24 * time.Hour),
+		NotAfter:     time.Now().Add(-365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	m := testManager(t)
+	var dials int32
+	m.EnableMimic(func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", addr)
+	})
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	get := m.GetCertificateFuncFor(host, port)
+	hello := &tls.ClientHelloInfo{ServerName: "expired.example.com"}
+	first, err := get(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Leaf.NotAfter.Equal(tmpl.NotAfter.Truncate(time.Second)) {
+		t.Fatalf("expected the copied validity, got %v", first.Leaf.NotAfter)
+	}
+	for i := 0; i < 3; i++ {
+		if again, err := get(hello); err != nil || again != first {
+			t.Fatalf("expected the mimicked certificate to be reused, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Fatalf("expected the server to be asked once, got %d dials", n)
+	}
+}
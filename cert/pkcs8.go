@@ -0,0 +1,131 @@
+package cert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encrypted PKCS#8 ("ENCRYPTED PRIVATE KEY", what "openssl genpkey -aes256"
+// and "openssl pkcs8 -topk8" write) with PBES2, which is all current tools
+// produce. The older PBES1 schemes are not supported.
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo to a PKCS#8 DER key
+func decryptPKCS8(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption %v, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+
+	var prf func() hash.Hash
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0, alg.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case alg.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACSHA384):
+		prf = sha512.New384
+	case alg.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 hash %v", alg)
+	}
+
+	var (
+		keyLen   int
+		newBlock func([]byte) (cipher.Block, error)
+	)
+	switch alg := params.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newBlock = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newBlock = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newBlock = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newBlock = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported cipher %v", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	block, err := newBlock(pbkdf2.Key([]byte(password), kdf.Salt, kdf.Iterations, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	data := info.Data
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted key")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// PKCS#7 padding; a wrong password almost always breaks it
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("incorrect password")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("incorrect password")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,269 @@
+package cert
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultStoreSize is the number of certificates kept in memory by default
+const DefaultStoreSize = 1024
+
+// CertStore keeps issued leaf certificates by key (usually the hostname).
+// Certificates returned by Get have Leaf set.
+type CertStore interface {
+	Get(key string) (*tls.Certificate, bool)
+	Put(key string, cert *tls.Certificate) error
+	Delete(key string)
+}
+
+// KeyStore is implemented by stores that also keep the private key shared
+// by the certificates a Manager issues, so it survives restarts
+type KeyStore interface {
+	LoadKey() (crypto.Signer, error) // nil, nil when there is none yet
+	SaveKey(key crypto.Signer) error
+}
+
+// Flusher is implemented by stores that can drop every certificate at
+// once, which Manager.SetCA does when the CA changes
+type Flusher interface {
+	Flush()
+}
+
+// MemoryStore is a CertStore that keeps the most recently used
+// certificates in memory
+type MemoryStore struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+// NewMemoryStore returns a store holding at most size certificates
+// (DefaultStoreSize if size <= 0)
+func NewMemoryStore(size int) *MemoryStore {
+	if size <= 0 {
+		size = DefaultStoreSize
+	}
+	return &MemoryStore{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (s *MemoryStore) Get(key string) (*tls.Certificate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*memoryEntry).cert, true
+}
+
+func (s *MemoryStore) Put(key string, cert *tls.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		e.Value.(*memoryEntry).cert = cert
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.items[key] = s.order.PushFront(&memoryEntry{key: key, cert: cert})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.order.Remove(e)
+		delete(s.items, key)
+	}
+}
+
+// Flush removes every certificate
+func (s *MemoryStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.order.Init()
+	s.items = make(map[string]*list.Element)
+}
+
+// Len returns the number of certificates in memory
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// DirStore is a CertStore that writes each certificate with its key to a
+// PEM file in the certs subdirectory of a directory, with a MemoryStore in
+// front of it. The shared key is kept in the directory itself.
+type DirStore struct {
+	dir    string
+	memory *MemoryStore
+}
+
+const (
+	dirStoreKeyFile  = "server.key"
+	dirStoreCertsDir = "certs" // only DirStore writes here, so Flush may empty it
+)
+
+// NewDirStore returns a store in dir, creating it if needed. size bounds the
+// in-memory cache as for NewMemoryStore.
+func NewDirStore(dir string, size int) (*DirStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, dirStoreCertsDir), 0o700); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir, memory: NewMemoryStore(size)}, nil
+}
+
+func (s *DirStore) Get(key string) (*tls.Certificate, bool) {
+	if cert, ok := s.memory.Get(key); ok {
+		return cert, true
+	}
+	data, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	cert, err := parseCertKeyPEM(data)
+	if err != nil {
+		return nil, false
+	}
+	s.memory.Put(key, cert)
+	return cert, true
+}
+
+func (s *DirStore) Put(key string, cert *tls.Certificate) error {
+	s.memory.Put(key, cert)
+	data, err := encodeCertKeyPEM(cert)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(key), data, 0o600)
+}
+
+func (s *DirStore) Delete(key string) {
+	s.memory.Delete(key)
+	os.Remove(s.path(key))
+}
+
+// Flush removes every certificate, keeping the server key
+func (s *DirStore) Flush() {
+	s.memory.Flush()
+	files, _ := filepath.Glob(filepath.Join(s.dir, dirStoreCertsDir, "*.pem"))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
+
+func (s *DirStore) LoadKey() (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, dirStoreKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", dirStoreKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", dirStoreKeyFile, key)
+	}
+	return signer, nil
+}
+
+func (s *DirStore) SaveKey(key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return writeFileAtomic(filepath.Join(s.dir, dirStoreKeyFile), data, 0o600)
+}
+
+// path maps a key to a file name that is safe on every platform
+func (s *DirStore) path(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return filepath.Join(s.dir, dirStoreCertsDir, b.String()+".pem")
+}
+
+func encodeCertKeyPEM(cert *tls.Certificate) ([]byte, error) {
+	var out []byte
+	for _, der := range cert.Certificate {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...), nil
+}
+
+func parseCertKeyPEM(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// writeFileAtomic writes through a temporary file so readers never see a
+// partial file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
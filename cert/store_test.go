@@ -0,0 +1,170 @@
+package cert_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo/cert"
+)
+
+func testManager(t *testing.T) *cert.Manager {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Echo Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := cert.NewManager(ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := cert.NewMemoryStore(2)
+	c := &tls.Certificate{}
+	s.Put("a", c)
+	s.Put("b", c)
+	s.Get("a")
+	s.Put("c", c)
+	if _, ok := s.Get("b"); ok {
+		t.Fatalf("expected b to be evicted")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Fatalf("expected a to be kept")
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", s.Len())
+	}
+}
+
+func TestDirStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	first := testManager(t)
+	store, err := cert.NewDirStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	issued, err := first.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh store on the same directory returns the same certificate
+	reopened, err := cert.NewDirStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := reopened.Get("example.com")
+	if !ok {
+		t.Fatalf("expected the certificate on disk")
+	}
+	if !bytes.Equal(loaded.Certificate[0], issued.Certificate[0]) {
+		t.Fatalf("expected the stored certificate")
+	}
+	if key, err := reopened.LoadKey(); err != nil || key == nil {
+		t.Fatalf("expected the server key on disk: %v", err)
+	}
+
+	// A manager with another CA reissues instead of serving it
+	other := testManager(t)
+	if err := other.SetStore(reopened); err != nil {
+		t.Fatal(err)
+	}
+	reissued, err := other.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(reissued.Certificate[0], issued.Certificate[0]) {
+		t.Fatalf("expected a certificate from the new CA")
+	}
+}
+
+func TestDirStoreFlushKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not the store's"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m := testManager(t)
+	store, err := cert.NewDirStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetCertificate("example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Flush()
+	if _, err := os.Stat(caFile); err != nil {
+		t.Fatalf("expected files the store did not write to survive Flush: %v", err)
+	}
+	if _, ok := store.Get("example.com"); ok {
+		t.Fatalf("expected the certificate to be flushed")
+	}
+	if key, err := store.LoadKey(); err != nil || key == nil {
+		t.Fatalf("expected the server key to survive Flush: %v", err)
+	}
+}
+
+func TestManagerRenewsBeforeExpiry(t *testing.T) {
+	m := testManager(t)
+	store := cert.NewMemoryStore(0)
+	m.SetStore(store)
+	issued, err := m.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.GetCertificate("example.com"); again != issued {
+		t.Fatalf("expected the cached certificate")
+	}
+
+	// Pretend the certificate is in its last days
+	stale := *issued
+	leaf := *issued.Leaf
+	leaf.NotBefore = time.Now().Add(-89 * 24 * time.Hour)
+	leaf.NotAfter = time.Now().Add(24 * time.Hour)
+	stale.Leaf = &leaf
+	store.Put("example.com", &stale)
+
+	renewed, err := m.GetCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == &stale || renewed.Leaf.NotAfter.Before(time.Now().Add(30*24*time.Hour)) {
+		t.Fatalf("expected a renewed certificate, got one valid until %v", renewed.Leaf.NotAfter)
+	}
+}
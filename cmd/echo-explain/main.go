@@ -0,0 +1,76 @@
+// Command echo-explain shows which plugins of an Echo config match a URL
+// and what Echo would do with the request.
+//
+// Usage:
+//
+//	echo-explain -config echo.yaml -cert rootCA.crt -key rootCA.key [-json] [METHOD] URL
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ltaoo/echo"
+)
+
+func main() {
+	configPath := flag.String("config", "", "config file (YAML or JSON)")
+	certPath := flag.String("cert", "rootCA.crt", "root CA certificate")
+	keyPath := flag.String("key", "rootCA.key", "root CA private key")
+	asJSON := flag.Bool("json", false, "print JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [METHOD] URL\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	method, target := "GET", flag.Arg(0)
+	switch flag.NArg() {
+	case 1:
+	case 2:
+		method, target = flag.Arg(0), flag.Arg(1)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	echo.SetLogEnabled(false)
+	certFile, err := os.ReadFile(*certPath)
+	if err != nil {
+		fail(err)
+	}
+	keyFile, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fail(err)
+	}
+
+	var e *echo.Echo
+	if *configPath != "" {
+		e, err = echo.NewEchoFromConfig(certFile, keyFile, *configPath)
+	} else {
+		e, err = echo.NewEcho(certFile, keyFile)
+	}
+	if err != nil {
+		fail(err)
+	}
+	defer e.Close()
+
+	ex, err := e.Explain(method, target)
+	if err != nil {
+		fail(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(ex)
+		return
+	}
+	fmt.Print(ex)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,757 @@
+package echo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ltaoo/echo/cert"
+	"gopkg.in/yaml.v3"
+)
+
+// Plugin group names used by the config loader
+const (
+	builtinBypassGroup = "builtin-bypass"
+	configGroup        = "config"
+)
+
+// configPollInterval is how often a watched config file is checked for changes
+const configPollInterval = time.Second
+
+// Config is the declarative form of Options and a plugin list.
+// It is usually loaded from a YAML or JSON file (JSON is valid YAML):
+//
+//	options:
+//	  builtin_bypass: true
+//	  intercept_only_matched: true
+//	  upstream_proxy: http://127.0.0.1:7890
+//	plugins:
+//	  - match: api.example.com
+//	    target: {protocol: http, host: 127.0.0.1, port: 3000}
+//	  - match: https://api.example.com/api/data
+//	    mock:
+//	      status: 200
+//	      headers: {Content-Type: application/json}
+//	      body: '{"ok":true}'
+//	  - match: "*.example.org"
+//	    request_headers:
+//	      set: {X-Debug: "1"}
+//	      delete: [Cookie]
+//	  - match: /^api\d+\.example\.com$/
+//	    methods: [POST]
+//	    headers: {Content-Type: "application/json*"}
+//	    response: {status: 2xx, content_type: [application/json]}
+//	    response_headers:
+//	      set: {X-Echo: "1"}
+//	  - match: pinned.example.net
+//	    bypass: true
+type Config struct {
+	Options ConfigOptions   `yaml:"options"`
+	Lists   []*ListSource   `yaml:"lists"`
+	Plugins []*PluginConfig `yaml:"plugins"`
+
+	file      string
+	listNodes []*yaml.Node // source positions of Lists, nil when built in code
+}
+
+// ConfigOptions mirrors Options in a config file
+type ConfigOptions struct {
+	EnableBuiltinBypass  bool          `yaml:"builtin_bypass"`
+	InterceptOnlyMatched bool          `yaml:"intercept_only_matched"`
+	UpstreamProxy        string        `yaml:"upstream_proxy"`
+	SniffTimeout         time.Duration `yaml:"sniff_timeout"` // e.g. "300ms"
+	MimicUpstreamCert    bool          `yaml:"mimic_upstream_cert"`
+	OnboardingHost       string        `yaml:"onboarding_host"`
+	DisableOnboarding    bool          `yaml:"disable_onboarding"`
+	CertKeyType          cert.KeyType  `yaml:"cert_key_type"` // e.g. "ecdsa-p256", "rsa-2048"
+	CAKeyPassword        string        `yaml:"ca_key_password"`
+	CertStoreDir         string        `yaml:"cert_store_dir"`
+	CertCacheSize        int           `yaml:"cert_cache_size"`
+	WildcardCerts        bool          `yaml:"wildcard_certs"`
+	PrewarmCerts         bool          `yaml:"prewarm_certs"`
+
+	LearnBypass          bool          `yaml:"learn_bypass"`
+	LearnBypassThreshold int           `yaml:"learn_bypass_threshold"`
+	LearnBypassTTL       time.Duration `yaml:"learn_bypass_ttl"` // e.g. "12h"
+}
+
+// PluginConfig is a declarative plugin
+type PluginConfig struct {
+	Match           string        `yaml:"match"`
+	Target          *TargetConfig `yaml:"target"`
+	Mock            *MockConfig   `yaml:"mock"`
+	RequestHeaders  *HeaderEdits  `yaml:"request_headers"`
+	ResponseHeaders *HeaderEdits  `yaml:"response_headers"`
+	Bypass          bool          `yaml:"bypass"`
+
+	// Request conditions, see Plugin
+	Methods    []string          `yaml:"methods"`
+	Query      map[string]string `yaml:"query"`
+	Headers    map[string]string `yaml:"headers"`
+	ClientAddr []string          `yaml:"client_addr"`
+
+	// Response conditions for response_headers, see Plugin.Response
+	Response *ResponseMatch `yaml:"response"`
+
+	// Several targets instead of target, see Plugin.Targets
+	Targets []*TargetConfig `yaml:"targets"`
+	Balance *Balance        `yaml:"balance"`
+
+	// Shadow target receiving a copy of each request, see Plugin.Mirror
+	Mirror *Mirror `yaml:"mirror"`
+
+	// Local files answering requests; a relative path is relative to the
+	// config file
+	MapLocal *MapLocal `yaml:"map_local"`
+
+	// TLS towards the server; relative paths are relative to the config file
+	UpstreamTLS *UpstreamTLS `yaml:"upstream_tls"`
+
+	node *yaml.Node // source position, nil when built in code
+	dir  string     // directory of the config file, "" when built in code
+}
+
+// MockConfig is a static response returned instead of forwarding
+type MockConfig struct {
+	Status  int               `yaml:"status"` // Defaults to 200
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+}
+
+// HeaderEdits deletes and then sets headers
+type HeaderEdits struct {
+	Set    map[string]string `yaml:"set"`
+	Delete []string          `yaml:"delete"`
+}
+
+// ConfigError is a config problem with its source position
+type ConfigError struct {
+	File string
+	Line int // 0 if unknown
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	case e.File != "":
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	default:
+		return e.Msg
+	}
+}
+
+// ConfigErrors collects every problem found in a config
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// ParseConfig parses and validates a YAML or JSON config
+func ParseConfig(data []byte) (*Config, error) {
+	return parseConfig(data, "")
+}
+
+// LoadConfigFile reads, parses and validates the config file at path
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data, path)
+}
+
+func parseConfig(data []byte, file string) (*Config, error) {
+	cfg := &Config{file: file}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return cfg, nil
+	}
+
+	// Strict decode catches syntax errors, unknown fields and type mismatches
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, yamlErrors(err, file)
+	}
+
+	// Decode again into a node tree to remember where each list and plugin
+	// starts
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, yamlErrors(err, file)
+	}
+	if seq := mappingValue(documentRoot(&root), "lists"); seq != nil && seq.Kind == yaml.SequenceNode {
+		cfg.listNodes = seq.Content
+	}
+	if seq := mappingValue(documentRoot(&root), "plugins"); seq != nil && seq.Kind == yaml.SequenceNode {
+		for i, item := range seq.Content {
+			if i < len(cfg.Plugins) && cfg.Plugins[i] != nil {
+				cfg.Plugins[i].node = item
+			}
+		}
+	}
+
+	if file != "" {
+		for _, pc := range cfg.Plugins {
+			if pc != nil {
+				pc.dir = filepath.Dir(file)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// yamlErrors converts yaml.v3 errors ("yaml: line 3: ...", "line 3: ...")
+// into ConfigErrors
+func yamlErrors(err error, file string) error {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	errs := make(ConfigErrors, 0, len(msgs))
+	for _, msg := range msgs {
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		ce := &ConfigError{File: file, Msg: msg}
+		var line int
+		if _, scanErr := fmt.Sscanf(msg, "line %d:", &line); scanErr == nil {
+			ce.Line = line
+			ce.Msg = strings.TrimSpace(msg[strings.Index(msg, ":")+1:])
+		}
+		errs = append(errs, ce)
+	}
+	return errs
+}
+
+func documentRoot(n *yaml.Node) *yaml.Node {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		return n.Content[0]
+	}
+	return n
+}
+
+// mappingValue returns the value node for key in a mapping node
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Validate checks the whole config and reports every problem at once
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	add := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{File: c.file, Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if c.Options.UpstreamProxy != "" {
+		u, err := url.Parse(c.Options.UpstreamProxy)
+		if err != nil || u.Host == "" {
+			add(0, "options.upstream_proxy: invalid URL %q", c.Options.UpstreamProxy)
+		} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			add(0, "options.upstream_proxy: unsupported scheme %q (supported: http, https, socks5)", u.Scheme)
+		}
+	}
+
+	if !c.Options.CertKeyType.Valid() {
+		add(0, "options.cert_key_type: unsupported key type %q (supported: ecdsa-p256, ecdsa-p384, rsa-2048, rsa-4096, ed25519)", c.Options.CertKeyType)
+	}
+
+	for i, src := range c.Lists {
+		line := 0
+		if i < len(c.listNodes) {
+			line = c.listNodes[i].Line
+		}
+		if src == nil {
+			add(line, "lists[%d]: empty list", i)
+		} else if err := src.validate(); err != nil {
+			add(line, "lists[%d]: %v", i, err)
+		}
+	}
+
+	for i, pc := range c.Plugins {
+		if pc == nil {
+			add(0, "plugins[%d]: empty plugin", i)
+			continue
+		}
+		line := pc.line("")
+		before := len(errs)
+		if strings.TrimSpace(pc.Match) == "" {
+			add(line, "plugins[%d]: match is required", i)
+		}
+		if _, err := compileResponseMatch(pc.Response); err != nil {
+			add(pc.line("response"), "plugins[%d].response: %v", i, err)
+		}
+		if _, err := compileUpstreamTLS(pc.upstreamTLS()); err != nil {
+			add(pc.line("upstream_tls"), "plugins[%d].upstream_tls: %v", i, err)
+		}
+		if err := pc.Balance.validate(); err != nil {
+			add(pc.line("balance"), "plugins[%d].balance: %v", i, err)
+		}
+		if _, err := compileMapLocal(pc.MapLocal, ""); err != nil {
+			add(pc.line("map_local"), "plugins[%d].map_local: %v", i, err)
+		}
+		if pc.Response != nil && pc.ResponseHeaders == nil {
+			add(pc.line("response"), "plugins[%d]: response conditions need response_headers", i)
+		}
+		hasTarget := pc.Target != nil || len(pc.Targets) > 0
+		if pc.Bypass && (hasTarget || pc.Mock != nil || pc.RequestHeaders != nil || pc.ResponseHeaders != nil) {
+			add(line, "plugins[%d]: bypass cannot be combined with target, mock or header edits", i)
+		}
+		if hasTarget && pc.Mock != nil {
+			add(line, "plugins[%d]: target and mock are mutually exclusive", i)
+		}
+		if pc.Target != nil && len(pc.Targets) > 0 {
+			add(line, "plugins[%d]: target and targets are mutually exclusive", i)
+		}
+		if t := pc.Target; t != nil {
+			for _, msg := range targetErrors(t) {
+				add(pc.line("target"), "plugins[%d].target: %s", i, msg)
+			}
+		}
+		for j, t := range pc.Targets {
+			if t == nil {
+				add(pc.line("targets"), "plugins[%d].targets[%d]: empty target", i, j)
+				continue
+			}
+			for _, msg := range targetErrors(t) {
+				add(pc.line("targets"), "plugins[%d].targets[%d]: %s", i, j, msg)
+			}
+		}
+		if m := pc.Mirror; m != nil {
+			if m.Target == nil {
+				add(pc.line("mirror"), "plugins[%d].mirror: target is required", i)
+			} else {
+				for _, msg := range targetErrors(m.Target) {
+					add(pc.line("mirror"), "plugins[%d].mirror.target: %s", i, msg)
+				}
+			}
+			if pc.Bypass || pc.Mock != nil {
+				add(line, "plugins[%d]: mirror cannot be combined with bypass or mock", i)
+			}
+		}
+		if pc.MapLocal != nil && (pc.Bypass || pc.Mock != nil) {
+			add(pc.line("map_local"), "plugins[%d]: map_local cannot be combined with bypass or mock", i)
+		}
+		if pc.Balance != nil && len(pc.Targets) == 0 {
+			add(pc.line("balance"), "plugins[%d]: balance needs targets", i)
+		}
+		if m := pc.Mock; m != nil && m.Status != 0 && (m.Status < 100 || m.Status > 599) {
+			add(pc.line("mock"), "plugins[%d].mock: invalid status %d", i, m.Status)
+		}
+		// Whatever else compilePlugin finds, without repeating the above
+		if len(errs) == before {
+			if _, err := compilePlugin(pc.ToPlugin()); err != nil {
+				add(pc.line("match"), "plugins[%d]: %v", i, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// targetErrors checks a target of a config plugin
+func targetErrors(t *TargetConfig) []string {
+	var errs []string
+	if t.Host == "" && t.Unix == "" {
+		errs = append(errs, "host or unix is required")
+	}
+	if t.Unix != "" && t.Dial != "" {
+		errs = append(errs, "unix and dial are mutually exclusive")
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port %d out of range", t.Port))
+	}
+	switch t.Protocol {
+	case "", "http", "https", "ws", "wss":
+	default:
+		errs = append(errs, fmt.Sprintf("unsupported protocol %q", t.Protocol))
+	}
+	if t.HostHeader != "" && t.PreserveHost {
+		errs = append(errs, "host_header and preserve_host are mutually exclusive")
+	}
+	if t.Dial != "" {
+		if _, _, err := net.SplitHostPort(t.Dial); err != nil {
+			errs = append(errs, fmt.Sprintf("dial must be host:port, got %q", t.Dial))
+		}
+	}
+	for _, prefix := range []string{t.StripPrefix, t.PathPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			errs = append(errs, fmt.Sprintf("path prefix %q must start with /", prefix))
+		}
+	}
+	if t.Weight < 0 {
+		errs = append(errs, fmt.Sprintf("negative weight %d", t.Weight))
+	}
+	return errs
+}
+
+// line returns the source line of key inside the plugin, or of the plugin
+// itself when key is empty or missing
+func (pc *PluginConfig) line(key string) int {
+	if pc.node == nil {
+		return 0
+	}
+	if key != "" && pc.node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(pc.node.Content); i += 2 {
+			if pc.node.Content[i].Value == key {
+				return pc.node.Content[i].Line
+			}
+		}
+	}
+	return pc.node.Line
+}
+
+// ToOptions returns the Options described by the config
+func (c *Config) ToOptions() *Options {
+	return &Options{
+		EnableBuiltinBypass:  c.Options.EnableBuiltinBypass,
+		InterceptOnlyMatched: c.Options.InterceptOnlyMatched,
+		UpstreamProxy:        c.Options.UpstreamProxy,
+		SniffTimeout:         c.Options.SniffTimeout,
+		MimicUpstreamCert:    c.Options.MimicUpstreamCert,
+		OnboardingHost:       c.Options.OnboardingHost,
+		DisableOnboarding:    c.Options.DisableOnboarding,
+		CertKeyType:          c.Options.CertKeyType,
+		CAKeyPassword:        c.Options.CAKeyPassword,
+		CertStoreDir:         c.Options.CertStoreDir,
+		CertCacheSize:        c.Options.CertCacheSize,
+		WildcardCerts:        c.Options.WildcardCerts,
+		PrewarmCerts:         c.Options.PrewarmCerts,
+		LearnBypass:          c.Options.LearnBypass,
+		LearnBypassThreshold: c.Options.LearnBypassThreshold,
+		LearnBypassTTL:       c.Options.LearnBypassTTL,
+	}
+}
+
+// ToPlugins builds the plugins described by the config, in order
+func (c *Config) ToPlugins() []*Plugin {
+	plugins := make([]*Plugin, 0, len(c.Plugins))
+	for _, pc := range c.Plugins {
+		plugins = append(plugins, pc.ToPlugin())
+	}
+	return plugins
+}
+
+// ToPlugin builds a Plugin from the declarative config
+func (pc *PluginConfig) ToPlugin() *Plugin {
+	p := &Plugin{
+		Match:       pc.Match,
+		Bypass:      pc.Bypass,
+		Methods:     pc.Methods,
+		Query:       pc.Query,
+		Headers:     pc.Headers,
+		ClientAddr:  pc.ClientAddr,
+		Response:    pc.Response,
+		UpstreamTLS: pc.upstreamTLS(),
+	}
+	if pc.Target != nil {
+		target := *pc.Target
+		target.Unix = pc.resolvePath(target.Unix)
+		p.Target = &target
+	}
+	for _, t := range pc.Targets {
+		if t == nil {
+			continue
+		}
+		target := *t
+		target.Unix = pc.resolvePath(target.Unix)
+		p.Targets = append(p.Targets, &target)
+	}
+	p.Balance = pc.Balance
+	if m := pc.Mirror; m != nil {
+		mirror := *m
+		if m.Target != nil {
+			target := *m.Target
+			target.Unix = pc.resolvePath(target.Unix)
+			mirror.Target = &target
+		}
+		p.Mirror = &mirror
+	}
+	if m := pc.MapLocal; m != nil {
+		local := *m
+		local.Path = pc.resolvePath(m.Path)
+		p.MapLocal = &local
+	}
+	if m := pc.Mock; m != nil {
+		status := m.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		p.MockResponse = &MockResponse{
+			StatusCode: status,
+			Headers:    m.Headers,
+			Body:       m.Body,
+		}
+	}
+	if edits := pc.RequestHeaders; edits != nil {
+		p.OnRequest = func(ctx *Context) {
+			if ctx.Req != nil {
+				edits.Apply(ctx.Req.Header)
+			}
+		}
+	}
+	if edits := pc.ResponseHeaders; edits != nil {
+		p.OnResponse = func(ctx *Context) {
+			if ctx.Res != nil {
+				edits.Apply(ctx.Res.Header)
+			}
+		}
+	}
+	return p
+}
+
+// upstreamTLS returns UpstreamTLS with paths resolved against the config file
+func (pc *PluginConfig) upstreamTLS() *UpstreamTLS {
+	if pc.UpstreamTLS == nil {
+		return nil
+	}
+	u := *pc.UpstreamTLS
+	u.RootCAs = make([]string, len(pc.UpstreamTLS.RootCAs))
+	for i, path := range pc.UpstreamTLS.RootCAs {
+		u.RootCAs[i] = pc.resolvePath(path)
+	}
+	u.ClientCert = pc.resolvePath(u.ClientCert)
+	u.ClientKey = pc.resolvePath(u.ClientKey)
+	return &u
+}
+
+// resolvePath makes a relative path relative to the config file
+func (pc *PluginConfig) resolvePath(path string) string {
+	if path == "" || pc.dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(pc.dir, path)
+}
+
+// Apply performs the edits on header
+func (e *HeaderEdits) Apply(header http.Header) {
+	for _, k := range e.Delete {
+		header.Del(k)
+	}
+	for k, v := range e.Set {
+		header.Set(k, v)
+	}
+}
+
+// NewEchoFromConfig creates an Echo instance from the config file at path
+// and keeps watching the file; see WatchConfig.
+func NewEchoFromConfig(certFile []byte, certKey []byte, path string) (*Echo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := NewEchoWithOptions(certFile, certKey, cfg.ToOptions())
+	if err != nil {
+		return nil, err
+	}
+	if err := e.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	e.startConfigWatcher(path, info)
+	return e, nil
+}
+
+// ApplyConfig validates cfg and atomically replaces the plugins that came
+// from a previous config. Plugins added with AddPlugin are kept.
+// InterceptOnlyMatched and UpstreamProxy only take effect at construction;
+// changing them here is logged and otherwise ignored.
+func (e *Echo) ApplyConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var bypass []*Plugin
+	if cfg.Options.EnableBuiltinBypass {
+		bypass = createBypassPlugins()
+	}
+	e.pluginLoader.setGroups(
+		[]string{builtinBypassGroup, configGroup},
+		[][]*Plugin{bypass, cfg.ToPlugins()},
+	)
+	e.applyConfigLists(cfg)
+	if e.options.PrewarmCerts {
+		e.prewarmCerts(e.pluginLoader.GetGroup(configGroup))
+	}
+
+	if cfg.Options.InterceptOnlyMatched != e.options.InterceptOnlyMatched {
+		log.Printf("[Config] intercept_only_matched changed, restart Echo to apply")
+	}
+	if cfg.Options.UpstreamProxy != e.options.UpstreamProxy {
+		log.Printf("[Config] upstream_proxy changed, restart Echo to apply")
+	}
+	if cfg.Options.MimicUpstreamCert != e.options.MimicUpstreamCert ||
+		cfg.Options.CertKeyType != e.options.CertKeyType ||
+		cfg.Options.CertStoreDir != e.options.CertStoreDir ||
+		cfg.Options.CertCacheSize != e.options.CertCacheSize ||
+		cfg.Options.WildcardCerts != e.options.WildcardCerts {
+		log.Printf("[Config] certificate options changed, restart Echo to apply")
+	}
+	if cfg.Options.OnboardingHost != e.options.OnboardingHost ||
+		cfg.Options.DisableOnboarding != e.options.DisableOnboarding {
+		log.Printf("[Config] onboarding options changed, restart Echo to apply")
+	}
+	if cfg.Options.SniffTimeout != e.options.SniffTimeout {
+		log.Printf("[Config] sniff_timeout changed, restart Echo to apply")
+	}
+	if cfg.Options.LearnBypass != e.options.LearnBypass ||
+		cfg.Options.LearnBypassThreshold != e.options.LearnBypassThreshold ||
+		cfg.Options.LearnBypassTTL != e.options.LearnBypassTTL {
+		log.Printf("[Config] learn_bypass settings changed, restart Echo to apply")
+	}
+	log.Printf("[Config] Applied %d plugin(s)", len(cfg.Plugins))
+	return nil
+}
+
+// applyConfigLists loads the lists of cfg and removes lists that an earlier
+// config loaded and cfg no longer has. A list that fails to load is logged.
+func (e *Echo) applyConfigLists(cfg *Config) {
+	var names []string
+	for _, src := range cfg.Lists {
+		src := *src
+		if src.Path != "" && cfg.file != "" && !filepath.IsAbs(src.Path) {
+			src.Path = filepath.Join(filepath.Dir(cfg.file), src.Path)
+		}
+		if err := e.LoadList(src); err != nil {
+			log.Printf("[Config] %v", err)
+		}
+		names = append(names, src.name())
+	}
+
+	e.mu.Lock()
+	previous := e.configLists
+	e.configLists = names
+	e.mu.Unlock()
+	for _, old := range previous {
+		kept := false
+		for _, name := range names {
+			kept = kept || name == old
+		}
+		if !kept {
+			e.RemoveList(old)
+		}
+	}
+}
+
+// WatchConfig loads and applies the config file at path, then polls it for
+// changes. A changed file that fails to parse or validate is reported and
+// the previous plugin set stays active. A file watched before, by
+// NewEchoFromConfig or an earlier call, is no longer watched. Watching
+// stops on Close.
+func (e *Echo) WatchConfig(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if err := e.ApplyConfig(cfg); err != nil {
+		return err
+	}
+	e.startConfigWatcher(path, info)
+	return nil
+}
+
+// LastConfigError returns the error of the most recent config reload,
+// or nil if it was applied
+func (e *Echo) LastConfigError() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.configErr
+}
+
+// startConfigWatcher polls path in place of any running config watcher
+func (e *Echo) startConfigWatcher(path string, info os.FileInfo) {
+	stop := make(chan struct{})
+	e.mu.Lock()
+	if e.configStop != nil {
+		close(e.configStop)
+	} else {
+		e.closers = append(e.closers, e.stopConfigWatcher)
+	}
+	e.configStop = stop
+	e.mu.Unlock()
+
+	go func() {
+		modTime, size := info.ModTime(), info.Size()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+
+			cfg, err := LoadConfigFile(path)
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err == nil {
+				err = e.ApplyConfig(cfg)
+			}
+			e.mu.Lock()
+			e.configErr = err
+			e.mu.Unlock()
+			if err != nil {
+				log.Printf("[Config] Reload of %s rejected, keeping previous config:\n%v", path, err)
+				continue
+			}
+			log.Printf("[Config] Reloaded %s", path)
+		}
+	}()
+}
+
+// stopConfigWatcher stops the config watcher on Close
+func (e *Echo) stopConfigWatcher() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.configStop != nil {
+		close(e.configStop)
+		e.configStop = nil
+	}
+}
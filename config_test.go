@@ -0,0 +1,150 @@
+package echo_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestParseConfig(t *testing.T) {
+	src := `
+options:
+  intercept_only_matched: true
+plugins:
+  - match: api.example.com
+    target: {protocol: http, host: 127.0.0.1, port: 3000}
+  - match: https://api.example.com/mock
+    mock:
+      body: '{"ok":true}'
+  - match: pinned.example.net
+    bypass: true
+`
+	cfg, err := echo.ParseConfig([]byte(src))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if !cfg.ToOptions().InterceptOnlyMatched {
+		t.Fatalf("expected intercept_only_matched")
+	}
+	plugins := cfg.ToPlugins()
+	if len(plugins) != 3 {
+		t.Fatalf("expected 3 plugins, got %d", len(plugins))
+	}
+	if plugins[0].Target == nil || plugins[0].Target.Port != 3000 {
+		t.Fatalf("unexpected target: %+v", plugins[0].Target)
+	}
+	if plugins[1].MockResponse == nil || plugins[1].MockResponse.StatusCode != 200 {
+		t.Fatalf("unexpected mock: %+v", plugins[1].MockResponse)
+	}
+	if !plugins[2].Bypass {
+		t.Fatalf("expected bypass plugin")
+	}
+}
+
+func TestParseConfigJSON(t *testing.T) {
+	src := "{\n\t\"plugins\": [\n\t\t{\"match\": \"example.com\", \"bypass\": true}\n\t]\n}\n"
+	cfg, err := echo.ParseConfig([]byte(src))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	if len(cfg.Plugins) != 1 || !cfg.Plugins[0].Bypass {
+		t.Fatalf("unexpected plugins: %+v", cfg.Plugins)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		src  string
+		line int
+	}{
+		{"unknown field", "plugins:\n  - match: a.com\n    tagret: {host: x}\n", 3},
+		{"missing match", "plugins:\n  - match: a.com\n  - bypass: true\n", 3},
+		{"bad port", "plugins:\n  - match: a.com\n    target:\n      host: x\n      port: 70000\n", 3},
+		{"bypass with mock", "plugins:\n  - match: a.com\n    bypass: true\n    mock: {body: x}\n", 2},
+		{"bad regex", "plugins:\n  - bypass: true\n    match: /a(/\n", 3},
+		{"syntax", "plugins:\n  - match: a.com\n\tbypass: true\n", 2},
+		{"bad balance", "plugins:\n  - match: a.com\n    targets: [{host: x}, {host: y}]\n    balance: {strategy: header}\n", 4},
+		{"target and targets", "plugins:\n  - match: a.com\n    target: {host: x}\n    targets: [{host: y}]\n", 2},
+		{"bad target in targets", "plugins:\n  - match: a.com\n    targets:\n      - host: x\n      - port: 80\n", 3},
+		{"bad list", "lists:\n  - path: a.txt\n  - url: http://x/list.txt\n    path: b.txt\n", 3},
+		{"map local without path", "plugins:\n  - match: a.com\n    map_local: {prefix: /static/}\n", 3},
+		{"map local with mock", "plugins:\n  - match: a.com\n    mock: {body: x}\n    map_local: {path: dist}\n", 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := echo.ParseConfig([]byte(c.src))
+			var errs echo.ConfigErrors
+			if !errors.As(err, &errs) || len(errs) == 0 {
+				t.Fatalf("expected ConfigErrors, got %v", err)
+			}
+			if errs[0].Line != c.line {
+				t.Fatalf("expected line %d, got %d (%v)", c.line, errs[0].Line, err)
+			}
+		})
+	}
+}
+
+func TestParseConfigReportsEveryPluginError(t *testing.T) {
+	src := "plugins:\n  - response: {status: 2xx-}\n    response_headers: {set: {X: y}}\n    targets: [{host: x}, {host: y}]\n    balance: {strategy: cookie}\n    map_local: {prefix: /static/}\n"
+	_, err := echo.ParseConfig([]byte(src))
+	var errs echo.ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{2, 2, 5, 6}) {
+		t.Fatalf("expected the missing match, response, balance and map_local errors, got\n%v", err)
+	}
+}
+
+func TestWatchConfigReplacesWatcher(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		src := "plugins:\n  - match: api.example.com\n    mock: {body: " + body + "}\n"
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	mock := func(e *echo.Echo) interface{} {
+		t.Helper()
+		ex, err := e.Explain("GET", "http://api.example.com/")
+		if err != nil || ex.Mock == nil {
+			t.Fatalf("expected a mock, got %v", err)
+		}
+		return ex.Mock.Body
+	}
+
+	e := newTestEcho(t, nil)
+	first := write("first.yaml", "first")
+	if err := e.WatchConfig(first); err != nil {
+		t.Fatal(err)
+	}
+	second := write("second.yaml", "second")
+	if err := e.WatchConfig(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the second file is watched now
+	write("second.yaml", "second-changed")
+	deadline := time.Now().Add(3 * time.Second)
+	for mock(e) != "second-changed" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	write("first.yaml", "first-changed")
+	time.Sleep(1500 * time.Millisecond)
+	if got := mock(e); got != "second-changed" {
+		t.Fatalf("expected only the second file to be watched, got %v", got)
+	}
+}
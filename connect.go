@@ -2,7 +2,9 @@ package echo
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/ltaoo/echo/cert"
+	"golang.org/x/net/http2"
 )
 
 // ConnectHandler handles CONNECT requests and MITM
@@ -23,12 +26,97 @@ type ConnectHandler struct {
 	HTTPHandler          *HTTPHandler // Shared HTTP handler
 	InterceptOnlyMatched bool         // Only intercept if plugin matches
 	UpstreamProxy        string       // Upstream proxy URL
-	mitmServers          sync.Map     // map[string]*MitmServer
+	// SniffTimeout is how long an intercepted tunnel waits for the client
+	// to speak before relaying it as an unknown protocol (default 500ms)
+	SniffTimeout time.Duration
+
+	mitmOnce     sync.Once
+	mitmListener *connListener  // feeds decrypted tunnels to the MITM server
+	learner      *bypassLearner // nil unless Options.LearnBypass is set
+}
+
+// ConnectAction is what HandleTunnel does with a CONNECT tunnel
+type ConnectAction int
+
+const (
+	// ConnectMITM sniffs the tunnel: TLS is decrypted and cleartext HTTP is
+	// served, both running request-level plugins; anything else is relayed
+	ConnectMITM ConnectAction = iota
+	// ConnectTunnel relays bytes to the target without looking at them
+	ConnectTunnel
+	// ConnectReject answers the CONNECT with an error status
+	ConnectReject
+	// ConnectRedirect relays bytes to another address
+	ConnectRedirect
+)
+
+func (a ConnectAction) String() string {
+	switch a {
+	case ConnectMITM:
+		return "mitm"
+	case ConnectTunnel:
+		return "tunnel"
+	case ConnectReject:
+		return "reject"
+	case ConnectRedirect:
+		return "redirect"
+	default:
+		return fmt.Sprintf("ConnectAction(%d)", int(a))
+	}
+}
+
+// connectDecision is the outcome of the CONNECT-stage rules
+type connectDecision struct {
+	Action   ConnectAction
+	Reason   string
+	Plugins  []*Plugin // plugins matched at CONNECT time
+	Status   int       // ConnectReject
+	Redirect string    // ConnectRedirect host:port
 }
 
-type MitmServer struct {
-	Port     int
-	Listener net.Listener
+// decide applies bypass plugins, InterceptOnlyMatched and the port 443
+// default to a CONNECT target
+func (h *ConnectHandler) decide(hostname, port, clientAddr string) connectDecision {
+	matched_plugins := h.PluginLoader.MatchConnect(hostname, port, clientAddr)
+	d := connectDecision{Plugins: matched_plugins}
+
+	// Any matched plugin with Bypass enabled wins
+	for _, p := range matched_plugins {
+		if p.Bypass {
+			d.Action = ConnectTunnel
+			d.Reason = fmt.Sprintf("bypass plugin %q matched", p.Match)
+			return d
+		}
+	}
+
+	if h.learner != nil {
+		if b, ok := h.learner.lookup(hostname); ok {
+			d.Action = ConnectTunnel
+			d.Reason = fmt.Sprintf("learned bypass until %s (%d handshake failure(s): %s)", b.ExpiresAt.Format(time.RFC3339), b.Failures, b.Reason)
+			return d
+		}
+	}
+
+	// Plugins that only pick the route to the target do not need MITM
+	intercepting := 0
+	for _, p := range matched_plugins {
+		if !p.routeOnly() {
+			intercepting++
+		}
+	}
+
+	switch {
+	case intercepting > 0:
+		d.Action = ConnectMITM
+		d.Reason = fmt.Sprintf("%d plugin(s) matched", intercepting)
+	case h.InterceptOnlyMatched:
+		d.Action = ConnectTunnel
+		d.Reason = "no plugin matched (intercept-only mode)"
+	default:
+		d.Action = ConnectMITM
+		d.Reason = "no plugin matched, sniffing the protocol"
+	}
+	return d
 }
 
 // HandleTunnel handles the CONNECT request
@@ -41,38 +129,16 @@ func (h *ConnectHandler) HandleTunnel(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[CONNECT] %s:%s", hostname, port)
 
-	// Check if there are plugin matches for this hostname
-	matched_plugins := h.PluginLoader.MatchPlugins(hostname)
-	log.Printf("[CONNECT] %s:%s matched %d plugin(s)", hostname, port, len(matched_plugins))
+	decision := h.decide(hostname, port, r.RemoteAddr)
+	log.Printf("[CONNECT] %s:%s matched %d plugin(s)", hostname, port, len(decision.Plugins))
 
-	// Check if any matched plugin has Bypass enabled
-	for _, p := range matched_plugins {
-		if p.Bypass {
-			log.Printf("[CONNECT] Bypass enabled for %s:%s, tunneling directly", hostname, port)
-			// Hijack and tunnel directly
-			hijacker, ok := w.(http.Hijacker)
-			if !ok {
-				http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-				return
-			}
-			clientConn, _, err := hijacker.Hijack()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusServiceUnavailable)
-				return
-			}
-			clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\nProxy-agent: echo\r\n\r\n"))
-			h.tunnelDirect(clientConn, hostname, port)
-			return
-		}
-	}
+	tunnel := &tunnelInfo{host: hostname, port: port, clientAddr: r.RemoteAddr, plugins: decision.Plugins}
+	h.runConnectHooks(r, &decision, tunnel)
 
-	should_intercept := false
-	if h.InterceptOnlyMatched {
-		// Only intercept if there are non-bypass plugins matched
-		should_intercept = len(matched_plugins) > 0
-	} else {
-		// Default: intercept all port 443 or any plugin match
-		should_intercept = (port == "443" || len(matched_plugins) > 0)
+	if decision.Action == ConnectReject {
+		log.Printf("[CONNECT] Rejecting %s:%s with %d: %s", hostname, port, decision.Status, decision.Reason)
+		http.Error(w, http.StatusText(decision.Status), decision.Status)
+		return
 	}
 
 	// Hijack connection
@@ -90,192 +156,304 @@ func (h *ConnectHandler) HandleTunnel(w http.ResponseWriter, r *http.Request) {
 	// Send 200 Connection Established
 	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\nProxy-agent: echo\r\n\r\n"))
 
-	// If not intercepting (no plugin match and not port 443), just tunnel directly
-	if !should_intercept {
-		if h.InterceptOnlyMatched {
-			log.Printf("[CONNECT] No plugin match for %s:%s, bypass (intercept-only mode)", hostname, port)
-		} else {
-			log.Printf("[CONNECT] No plugin match for %s:%s, tunneling directly", hostname, port)
+	// If not intercepting, just tunnel directly
+	switch decision.Action {
+	case ConnectTunnel:
+		log.Printf("[CONNECT] Tunneling %s:%s directly: %s", hostname, port, decision.Reason)
+		h.tunnelDirect(clientConn, hostname, port, tunnel)
+		return
+	case ConnectRedirect:
+		redirectHost, redirectPort, err := net.SplitHostPort(decision.Redirect)
+		if err != nil {
+			log.Printf("[CONNECT] Invalid redirect address %q for %s:%s: %v", decision.Redirect, hostname, port, err)
+			clientConn.Close()
+			return
 		}
-		h.tunnelDirect(clientConn, hostname, port)
+		log.Printf("[CONNECT] Redirecting %s:%s -> %s: %s", hostname, port, decision.Redirect, decision.Reason)
+		h.tunnelDirect(clientConn, redirectHost, redirectPort, tunnel)
 		return
 	}
 
-	if len(matched_plugins) > 0 {
-		log.Printf("[CONNECT] Intercepting %s:%s (%d plugin(s) matched)", hostname, port, len(matched_plugins))
-	} else {
-		log.Printf("[CONNECT] Intercepting %s:%s (port 443)", hostname, port)
-	}
+	log.Printf("[CONNECT] Intercepting %s:%s (%s)", hostname, port, decision.Reason)
 
-	// Peek first byte to check for TLS
-	// We need to read without consuming, or read and put back
-	// Using bufio.Reader to peek
-	bufClientConn := bufio.NewReader(clientConn)
-	peekBytes, err := bufClientConn.Peek(1)
+	// Peek at the first bytes to pick a protocol without consuming them
+	bufClientConn := bufio.NewReaderSize(clientConn, sniffBufferSize)
+	proto, sni, err := sniff(clientConn, bufClientConn, h.sniffTimeout())
 	if err != nil {
 		// Client might have closed or error
 		clientConn.Close()
 		return
 	}
-
-	// Check for TLS handshake (0x16)
-	if peekBytes[0] == 0x16 {
-		// It's TLS, start MITM
-		h.handleMitm(clientConn, bufClientConn, hostname)
-	} else {
-		// Not TLS, tunnel directly
-		log.Printf("[Protocol Sniffing] Non-TLS traffic on port 443 for %s. Bypassing MITM.", hostname)
-		h.tunnelDirectWithBuffer(clientConn, bufClientConn, hostname, port)
+	tunnel.sni = sni
+
+	switch proto {
+	case ProtocolTLS:
+		h.handleMitm(clientConn, bufClientConn, tunnel)
+	case ProtocolHTTP1:
+		log.Printf("[Protocol Sniffing] Cleartext HTTP for %s:%s", hostname, port)
+		h.serveMitm(&tunnelConn{Conn: &bufferedConn{Conn: clientConn, r: bufClientConn}, tunnel: tunnel})
+	case ProtocolHTTP2:
+		log.Printf("[Protocol Sniffing] Cleartext HTTP/2 for %s:%s", hostname, port)
+		h.serveHTTP2(&tunnelConn{Conn: &bufferedConn{Conn: clientConn, r: bufClientConn}, tunnel: tunnel})
+	default:
+		log.Printf("[Protocol Sniffing] %s traffic for %s:%s, tunneling without MITM", proto, hostname, port)
+		h.tunnelDirectWithBuffer(clientConn, bufClientConn, hostname, port, tunnel)
 	}
 }
 
-func (h *ConnectHandler) tunnelDirect(clientConn net.Conn, hostname, port string) {
-	var targetConn net.Conn
-	var err error
+// useUpstream reports whether a tunnel to the host goes through UpstreamProxy
+func (h *ConnectHandler) useUpstream(hostname, port, clientAddr string) bool {
+	return h.UpstreamProxy != "" && !h.PluginLoader.direct(hostname, port, clientAddr)
+}
 
-	if h.UpstreamProxy != "" {
+// dialTarget connects to the target of a tunnel, through the upstream proxy
+// when one applies to clientAddr
+func (h *ConnectHandler) dialTarget(clientConn net.Conn, hostname, port, clientAddr string) (net.Conn, error) {
+	if h.useUpstream(hostname, port, clientAddr) {
 		// Connect to upstream proxy and tunnel through it
-		targetConn, err = h.dialUpstreamProxy(clientConn, hostname, port)
-		// Fallback to direct if upstream proxy fails
-		if err != nil {
-			log.Printf("[UpstreamProxy] Failed, falling back to direct: %v", err)
-			targetConn, err = net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 10*time.Second)
+		targetConn, err := h.dialUpstreamProxy(clientConn, hostname, port)
+		if err == nil {
+			return targetConn, nil
 		}
-	} else {
-		// Direct connection to target
-		targetConn, err = net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 10*time.Second)
-	}
-
-	if err != nil {
-		log.Printf("[Tunnel Error] %v", err)
-		clientConn.Close()
-		return
+		// Fallback to direct if upstream proxy fails
+		log.Printf("[UpstreamProxy] Failed, falling back to direct: %v", err)
 	}
-
-	go transfer(targetConn, clientConn)
-	go transfer(clientConn, targetConn)
+	return net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 10*time.Second)
 }
 
-func (h *ConnectHandler) tunnelDirectWithBuffer(clientConn net.Conn, bufClientConn *bufio.Reader, hostname, port string) {
-	var targetConn net.Conn
-	var err error
-
-	if h.UpstreamProxy != "" {
-		targetConn, err = h.dialUpstreamProxy(clientConn, hostname, port)
-		if err != nil {
-			log.Printf("[UpstreamProxy] Failed, falling back to direct: %v", err)
-			targetConn, err = net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 10*time.Second)
-		}
-	} else {
-		targetConn, err = net.DialTimeout("tcp", net.JoinHostPort(hostname, port), 10*time.Second)
-	}
+func (h *ConnectHandler) tunnelDirect(clientConn net.Conn, hostname, port string, tunnel *tunnelInfo) {
+	h.tunnelDirectWithBuffer(clientConn, clientConn, hostname, port, tunnel)
+}
 
+// tunnelDirectWithBuffer relays a tunnel whose first bytes may already be
+// buffered in clientReader
+func (h *ConnectHandler) tunnelDirectWithBuffer(clientConn net.Conn, clientReader io.Reader, hostname, port string, tunnel *tunnelInfo) {
+	targetConn, err := h.dialTarget(clientConn, hostname, port, tunnel.clientAddr)
 	if err != nil {
 		log.Printf("[Tunnel Error] %v", err)
 		clientConn.Close()
 		return
 	}
-
-	// We need to write the buffered data to target first
-	// Since we can't easily get the buffer out of bufio.Reader without reading,
-	// we'll wrap it or just copy from it.
-
-	go func() {
-		defer targetConn.Close()
-		defer clientConn.Close()
-
-		// Copy from buffered reader to target
-		_, err := bufClientConn.WriteTo(targetConn)
-		if err != nil {
-			return
-		}
-	}()
-
-	go transfer(clientConn, targetConn)
+	relay(clientConn, clientReader, targetConn, tunnel)
 }
 
-func (h *ConnectHandler) handleMitm(clientConn net.Conn, bufClientConn *bufio.Reader, hostname string) {
-	// Get or create MITM server for this hostname
-	mitmServer, err := h.getMitmServer(hostname)
+// relayTLS relays a decrypted tunnel that is not HTTP over a new TLS
+// connection to the target
+func (h *ConnectHandler) relayTLS(clientConn net.Conn, clientReader io.Reader, tunnel *tunnelInfo) {
+	targetConn, err := h.dialTarget(clientConn, tunnel.host, tunnel.port, tunnel.clientAddr)
 	if err != nil {
-		log.Printf("[MITM Error] Failed to get MITM server: %v", err)
+		log.Printf("[Tunnel Error] %v", err)
 		clientConn.Close()
 		return
 	}
-
-	// Connect to local MITM server
-	localConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", mitmServer.Port))
-	if err != nil {
-		log.Printf("[MITM Error] Failed to connect to local MITM server: %v", err)
+	serverName := tunnel.sni
+	if serverName == "" {
+		serverName = tunnel.host
+	}
+	config := h.PluginLoader.upstreamTLS(tunnel.host, tunnel.port, tunnel.clientAddr).clientConfig(serverName)
+	// Servers that insist on ALPN get what the client asked for
+	config.NextProtos = tunnel.alpn
+	tlsConn := tls.Client(targetConn, config)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("[Tunnel Error] TLS handshake with %s failed: %v", config.ServerName, err)
+		targetConn.Close()
 		clientConn.Close()
 		return
 	}
-
-	// Pipe data
-	go func() {
-		defer localConn.Close()
-		defer clientConn.Close()
-		bufClientConn.WriteTo(localConn)
-	}()
-
-	go transfer(clientConn, localConn)
+	tlsConn.SetDeadline(time.Time{})
+	relay(clientConn, clientReader, tlsConn, tunnel)
 }
 
-func (h *ConnectHandler) getMitmServer(hostname string) (*MitmServer, error) {
-	// Check cache
-	if val, ok := h.mitmServers.Load(hostname); ok {
-		return val.(*MitmServer), nil
+// runConnectHooks lets OnConnect hooks of the matched plugins override the
+// decision and attach metadata to the tunnel
+func (h *ConnectHandler) runConnectHooks(r *http.Request, d *connectDecision, t *tunnelInfo) {
+	ctx := &ConnectContext{
+		Req:        r,
+		Host:       t.host,
+		Port:       t.port,
+		ClientAddr: t.clientAddr,
+		User:       proxyUser(r),
+		action:     d.Action,
+		status:     http.StatusForbidden,
+	}
+	for _, p := range d.Plugins {
+		if p.OnConnect == nil {
+			continue
+		}
+		before := *ctx
+		p.OnConnect(ctx)
+		if ctx.action != before.action || ctx.redirect != before.redirect || ctx.status != before.status {
+			d.Reason = fmt.Sprintf("OnConnect hook of plugin %q", p.Match)
+		}
 	}
+	d.Action = ctx.action
+	d.Status = ctx.status
+	d.Redirect = ctx.redirect
+	t.meta = ctx.meta
+}
 
-	// Create new MITM server
-	// We listen on a random port
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
+// proxyUser returns the user name of a Basic Proxy-Authorization header
+func proxyUser(r *http.Request) string {
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
 	if err != nil {
-		return nil, err
+		return ""
 	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	return user
+}
 
-	port := listener.Addr().(*net.TCPAddr).Port
-	log.Printf("[Dynamic Server] Started for %s on port %d", hostname, port)
-
-	// Create a custom handler that supports both HTTP and WebSocket upgrade
-	server := &http.Server{
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check if it's a WebSocket upgrade request
-			if IsWebSocketRequest(r) {
-				log.Printf("[MITM Server] Detected WebSocket upgrade request for %s", hostname)
-				wsHandler := &WebSocketHandler{PluginLoader: h.PluginLoader}
-				wsHandler.HandleUpgrade(w, r, true) // true for secure (wss)
-				return
-			}
-			// Otherwise handle as normal HTTP
-			h.handleMitmRequest(w, r, hostname)
-		}),
-		TLSConfig: &tls.Config{
-			GetCertificate: h.CertManager.GetCertificateFunc(),
+func (h *ConnectHandler) handleMitm(clientConn net.Conn, bufClientConn *bufio.Reader, tunnel *tunnelInfo) {
+	tunnel.tls = true
+	getCertificate := h.CertManager.GetCertificateFuncFor(tunnel.host, tunnel.port)
+	certSent := false
+	config := &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCertificate(hello)
+			certSent = err == nil
+			return cert, err
 		},
 	}
+	// Agree on h2 or http/1.1 with clients that offer them, so they are
+	// known to speak HTTP; other ALPN offers are left unanswered rather than
+	// refused
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		tunnel.alpn = hello.SupportedProtos
+		var protos []string
+		for _, proto := range []string{"h2", "http/1.1"} {
+			for _, offered := range hello.SupportedProtos {
+				if offered == proto {
+					protos = append(protos, proto)
+				}
+			}
+		}
+		if len(protos) == 0 {
+			return nil, nil
+		}
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.NextProtos = protos
+		return c, nil
+	}
+	tlsConn := tls.Server(&bufferedConn{Conn: clientConn, r: bufClientConn}, config)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("[MITM Error] TLS handshake with client for %s failed: %v", tunnel.host, err)
+		clientConn.Close()
+		if h.learner == nil || !certSent {
+			return
+		}
+		if reason, ok := pinningFailure(err); ok && h.learner.failure(tunnel.host, reason) {
+			log.Printf("[Learn] Bypassing %s: clients keep rejecting its certificate (%s)", tunnel.host, reason)
+		}
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if h.learner != nil {
+		h.learner.success(tunnel.host)
+	}
 
-	go server.ServeTLS(listener, "", "")
+	// Decrypted tunnels that do not carry HTTP are relayed as streams;
+	// clients that sent no ALPN are sniffed
+	bufTLSConn := bufio.NewReader(tlsConn)
+	var proto Protocol
+	switch tlsConn.ConnectionState().NegotiatedProtocol {
+	case "h2":
+		proto = ProtocolHTTP2
+	case "http/1.1":
+		proto = ProtocolHTTP1
+	default:
+		var err error
+		proto, _, err = sniff(tlsConn, bufTLSConn, h.sniffTimeout())
+		if err != nil {
+			tlsConn.Close()
+			return
+		}
+	}
+	conn := &tunnelConn{Conn: &bufferedConn{Conn: tlsConn, r: bufTLSConn}, tunnel: tunnel}
+	switch proto {
+	case ProtocolHTTP1:
+		h.serveMitm(conn)
+	case ProtocolHTTP2:
+		h.serveHTTP2(conn)
+	default:
+		log.Printf("[MITM] %s traffic inside TLS for %s:%s, relaying as a stream", proto, tunnel.host, tunnel.port)
+		h.relayTLS(tlsConn, bufTLSConn, tunnel)
+	}
+}
 
-	mitmServer := &MitmServer{
-		Port:     port,
-		Listener: listener,
+func (h *ConnectHandler) sniffTimeout() time.Duration {
+	if h.SniffTimeout <= 0 {
+		return defaultSniffTimeout
 	}
+	return h.SniffTimeout
+}
 
-	h.mitmServers.Store(hostname, mitmServer)
-	return mitmServer, nil
+// serveMitm hands a decrypted tunnel to the shared in-process MITM server
+func (h *ConnectHandler) serveMitm(conn *tunnelConn) {
+	h.mitmOnce.Do(func() {
+		h.mitmListener = newConnListener()
+		server := &http.Server{
+			Handler:     http.HandlerFunc(h.handleMitmRequest),
+			ConnContext: withTunnel,
+		}
+		go server.Serve(h.mitmListener)
+	})
+	h.mitmListener.push(conn)
+}
+
+// serveHTTP2 serves an HTTP/2 tunnel, cleartext with prior knowledge or
+// decrypted after agreeing on h2, with the same handler as HTTP/1.x; it
+// returns when the connection is done
+func (h *ConnectHandler) serveHTTP2(conn *tunnelConn) {
+	server := &http2.Server{}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: withTunnel(context.Background(), conn),
+		Handler: http.HandlerFunc(h.handleMitmRequest),
+	})
 }
 
-func (h *ConnectHandler) handleMitmRequest(w http.ResponseWriter, r *http.Request, originalHostname string) {
+func (h *ConnectHandler) handleMitmRequest(w http.ResponseWriter, r *http.Request) {
+	tunnel := tunnelFromContext(r.Context())
+
 	// This is the decrypted request!
 	// Reconstruct the URL
-	r.URL.Scheme = "https"
+	r.URL.Scheme = "http"
+	defaultPort := "80"
+	if tunnel.tls {
+		r.URL.Scheme = "https"
+		defaultPort = "443"
+	}
 	r.URL.Host = r.Host
 	if r.URL.Host == "" {
-		r.URL.Host = originalHostname
+		r.URL.Host = tunnel.host
+		if tunnel.sni != "" {
+			r.URL.Host = tunnel.sni
+		}
+		if tunnel.port != defaultPort {
+			r.URL.Host = net.JoinHostPort(r.URL.Host, tunnel.port)
+		}
+	}
+	// Report the real client instead of the in-process connection
+	r.RemoteAddr = tunnel.clientAddr
+
+	// Check if it's a WebSocket upgrade request
+	if IsWebSocketRequest(r) {
+		log.Printf("[MITM Server] Detected WebSocket upgrade request for %s", tunnel.host)
+		wsHandler := &WebSocketHandler{PluginLoader: h.PluginLoader}
+		wsHandler.HandleUpgrade(w, r, tunnel.tls)
+		return
 	}
 
-	log.Printf("[HTTPS MITM] %s %s (Host: %s)", r.Method, r.URL.String(), r.Host)
+	if tunnel.tls {
+		log.Printf("[HTTPS MITM] %s %s (Host: %s)", r.Method, r.URL.String(), r.Host)
+	} else {
+		log.Printf("[HTTP Tunnel] %s %s (Host: %s)", r.Method, r.URL.String(), r.Host)
+	}
 
 	// Reuse HTTP handler logic
 	// Use the shared HTTPHandler if available, otherwise create one (fallback)
@@ -286,6 +464,44 @@ func (h *ConnectHandler) handleMitmRequest(w http.ResponseWriter, r *http.Reques
 	handler.HandleRequest(w, r)
 }
 
+// relay copies bytes both ways between the client and the target, through
+// the OnTCPStream hooks of the tunnel's plugins when there are any
+func relay(clientConn net.Conn, clientReader io.Reader, targetConn net.Conn, tunnel *tunnelInfo) {
+	streams := tunnel.streams()
+	if len(streams) == 0 {
+		go func() {
+			defer targetConn.Close()
+			defer clientConn.Close()
+			io.Copy(targetConn, clientReader)
+		}()
+		go transfer(clientConn, targetConn)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer targetConn.Close()
+		defer clientConn.Close()
+		copyStream(targetConn, clientReader, streams, true)
+	}()
+	go func() {
+		defer wg.Done()
+		defer targetConn.Close()
+		defer clientConn.Close()
+		copyStream(clientConn, targetConn, streams, false)
+	}()
+	go func() {
+		wg.Wait()
+		for _, s := range streams {
+			if s.OnClose != nil {
+				s.OnClose()
+			}
+		}
+	}()
+}
+
 func transfer(dst io.WriteCloser, src io.ReadCloser) {
 	defer dst.Close()
 	defer src.Close()
@@ -0,0 +1,422 @@
+package echo_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+	"golang.org/x/net/http2"
+)
+
+// proxyClient returns a client that sends requests through proxy and trusts
+// any certificate, as the MITM certificates come from a throwaway CA
+func proxyClient(proxy *httptest.Server, user string) *http.Client {
+	proxyURL, _ := url.Parse(proxy.URL)
+	if user != "" {
+		proxyURL.User = url.UserPassword(user, "secret")
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func TestOnConnect(t *testing.T) {
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match: "api.example.com",
+		OnConnect: func(ctx *echo.ConnectContext) {
+			if ctx.User == "" {
+				ctx.Reject(http.StatusProxyAuthRequired)
+				return
+			}
+			ctx.Set("user", ctx.User)
+		},
+		OnRequest: func(ctx *echo.Context) {
+			user, _ := ctx.Get("user").(string)
+			ctx.Mock(http.StatusOK, nil, "hello "+user)
+		},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	if _, err := proxyClient(proxy, "").Get("https://api.example.com/"); err == nil {
+		t.Fatalf("expected the CONNECT to be rejected")
+	}
+
+	res, err := proxyClient(proxy, "alice").Get("https://api.example.com/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "hello alice" {
+		t.Fatalf("expected %q, got %q", "hello alice", body)
+	}
+}
+
+func TestConnectRejectStatus(t *testing.T) {
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match:     "api.example.com",
+		OnConnect: func(ctx *echo.ConnectContext) { ctx.Reject(0) },
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "CONNECT api.example.com:443 HTTP/1.1\r\nHost: api.example.com:443\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected an invalid status to become 403, got %d", res.StatusCode)
+	}
+}
+
+func TestLearnBypass(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{LearnBypass: true, LearnBypassThreshold: 2})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	// A client that does not trust the MITM CA behaves like a pinned app
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for i := 0; i < 2; i++ {
+		if len(e.LearnedBypasses()) != 0 {
+			t.Fatalf("learned a bypass after %d failure(s)", i)
+		}
+		if _, err := client.Get("https://pinned.example.com/"); err == nil {
+			t.Fatalf("expected the handshake to fail")
+		}
+	}
+
+	// The proxy sees the alert after the client has given up
+	deadline := time.Now().Add(2 * time.Second)
+	for len(e.LearnedBypasses()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	learned := e.LearnedBypasses()
+	if len(learned) != 1 || learned[0].Host != "pinned.example.com" {
+		t.Fatalf("expected pinned.example.com to be learned, got %+v", learned)
+	}
+	ex, err := e.Explain("GET", "https://pinned.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Connect.Action != echo.ConnectTunnel {
+		t.Fatalf("expected a tunnel, got %s (%s)", ex.Connect.Action, ex.Connect.Reason)
+	}
+
+	if !e.ForgetLearnedBypass("pinned.example.com") || len(e.LearnedBypasses()) != 0 {
+		t.Fatalf("expected the bypass to be forgotten")
+	}
+	e.RestoreLearnedBypasses(learned)
+	if len(e.LearnedBypasses()) != 1 {
+		t.Fatalf("expected the bypass to be restored")
+	}
+}
+
+func TestLearnBypassIgnoresClosedHandshakes(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{LearnBypass: true, LearnBypassThreshold: 1})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	for i := 0; i < 3; i++ {
+		conn, br := dialTunnel(t, proxy, "flaky.example.com:443")
+		// Hang up as soon as the server's flight arrives, without an alert
+		client := tls.Client(&readerConn{Conn: conn, r: &closingReader{r: br, conn: conn}}, &tls.Config{ServerName: "flaky.example.com"})
+		if err := client.Handshake(); err == nil {
+			t.Fatalf("expected the handshake to be cut off")
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if learned := e.LearnedBypasses(); len(learned) != 0 {
+		t.Fatalf("expected closed handshakes not to be learned, got %+v", learned)
+	}
+}
+
+// closingReader closes conn after the first read
+type closingReader struct {
+	r    io.Reader
+	conn net.Conn
+}
+
+func (c *closingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.conn.Close()
+	return n, err
+}
+
+// readerConn reads through r, which may hold bytes read past a response
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialTunnel opens a CONNECT tunnel to addr through proxy
+func dialTunnel(t *testing.T, proxy *httptest.Server, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("CONNECT %s: %v", addr, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %s", addr, res.Status)
+	}
+	return conn, br
+}
+
+func TestProtocolSniffing(t *testing.T) {
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match: "*",
+		OnRequest: func(ctx *echo.Context) {
+			ctx.Mock(http.StatusOK, nil, ctx.Req.URL.String())
+		},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	t.Run("cleartext http", func(t *testing.T) {
+		conn, br := dialTunnel(t, proxy, "plain.example.com:8080")
+		fmt.Fprintf(conn, "GET /path HTTP/1.1\r\nHost: plain.example.com:8080\r\n\r\n")
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "http://plain.example.com:8080/path" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	})
+
+	t.Run("cleartext http2", func(t *testing.T) {
+		conn, br := dialTunnel(t, proxy, "h2c.example.com:8080")
+		transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return &readerConn{Conn: conn, r: br}, nil
+			},
+		}
+		res, err := (&http.Client{Transport: transport}).Get("http://h2c.example.com:8080/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.ProtoMajor != 2 || string(body) != "http://h2c.example.com:8080/path" {
+			t.Fatalf("expected an HTTP/2 answer from the handler, got %s %q", res.Proto, body)
+		}
+	})
+
+	t.Run("tls on another port", func(t *testing.T) {
+		res, err := proxyClient(proxy, "").Get("https://secure.example.com:8443/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "https://secure.example.com:8443/path" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	})
+
+	t.Run("tls http2", func(t *testing.T) {
+		client := proxyClient(proxy, "")
+		client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+		res, err := client.Get("https://h2.example.com/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if res.ProtoMajor != 2 || string(body) != "https://h2.example.com/path" {
+			t.Fatalf("expected an HTTP/2 answer from the handler, got %s %q", res.Proto, body)
+		}
+	})
+
+	t.Run("tls http2 without alpn", func(t *testing.T) {
+		conn, br := dialTunnel(t, proxy, "grpc.example.com:443")
+		transport := &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				tlsConn := tls.Client(&readerConn{Conn: conn, r: br}, &tls.Config{InsecureSkipVerify: true})
+				return tlsConn, tlsConn.Handshake()
+			},
+		}
+		res, err := (&http.Client{Transport: transport}).Get("https://grpc.example.com/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "https://grpc.example.com/path" {
+			t.Fatalf("expected an answer from the handler, got %q", body)
+		}
+	})
+
+	t.Run("server speaks first", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			io.WriteString(c, "220 ready\r\n")
+			io.Copy(c, c)
+		}()
+
+		conn, br := dialTunnel(t, proxy, ln.Addr().String())
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		banner, err := br.ReadString('\n')
+		if err != nil || banner != "220 ready\r\n" {
+			t.Fatalf("expected the banner, got %q (%v)", banner, err)
+		}
+		io.WriteString(conn, "PING\r\n")
+		if echoed, _ := br.ReadString('\n'); echoed != "PING\r\n" {
+			t.Fatalf("expected the raw tunnel to relay data, got %q", echoed)
+		}
+	})
+}
+
+func TestOnTCPStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	closed := make(chan struct{})
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match: "127.0.0.1",
+		OnTCPStream: func(s *echo.TCPStream) {
+			s.OnClientData = func(data []byte) []byte {
+				return bytes.ToUpper(data)
+			}
+			s.OnServerData = func(data []byte) []byte {
+				return append([]byte("< "), data...)
+			}
+			s.OnClose = func() { close(closed) }
+		},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	conn, br := dialTunnel(t, proxy, ln.Addr().String())
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil || line != "< PING\n" {
+		t.Fatalf("expected the hooks to rewrite both directions, got %q (%v)", line, err)
+	}
+	conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("OnClose was not called")
+	}
+}
+
+func TestMimicUpstreamCert(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	upstream := backend.Certificate()
+
+	for _, mimic := range []bool{false, true} {
+		e := newTestEcho(t, &echo.Options{MimicUpstreamCert: mimic})
+		e.AddPlugin(&echo.Plugin{
+			Match:     "*",
+			OnRequest: func(ctx *echo.Context) { ctx.Mock(http.StatusOK, nil, "ok") },
+		})
+		proxy := httptest.NewServer(e)
+		defer proxy.Close()
+
+		// An IP target makes the client send no SNI
+		res, err := proxyClient(proxy, "").Get(backend.URL)
+		if err != nil {
+			t.Fatalf("mimic=%v: GET: %v", mimic, err)
+		}
+		res.Body.Close()
+		leaf := res.TLS.PeerCertificates[0]
+		if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+			t.Fatalf("mimic=%v: %v", mimic, err)
+		}
+		copied := reflect.DeepEqual(leaf.DNSNames, upstream.DNSNames) &&
+			reflect.DeepEqual(leaf.Subject.Organization, upstream.Subject.Organization) &&
+			leaf.NotAfter.Equal(upstream.NotAfter)
+		if copied != mimic {
+			t.Fatalf("mimic=%v: got SANs %v, subject %v, not after %v", mimic, leaf.DNSNames, leaf.Subject, leaf.NotAfter)
+		}
+	}
+}
+
+func TestRelayTLSForwardsALPN(t *testing.T) {
+	// A server that only speaks its protocol when it is agreed in ALPN
+	backend := httptest.NewUnstartedServer(nil)
+	backend.TLS = &tls.Config{NextProtos: []string{"x-echo"}}
+	backend.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		"x-echo": func(_ *http.Server, c *tls.Conn, _ http.Handler) {
+			io.WriteString(c, "x-echo\n")
+		},
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match:       "127.0.0.1",
+		UpstreamTLS: &echo.UpstreamTLS{RootCAs: []string{writePEM(t, backend.Certificate())}},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	conn, br := dialTunnel(t, proxy, backend.Listener.Addr().String())
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tlsConn := tls.Client(&readerConn{Conn: conn, r: br}, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"x-echo"}})
+	io.WriteString(tlsConn, "hello\n")
+	line, err := bufio.NewReader(tlsConn).ReadString('\n')
+	if err != nil || line != "x-echo\n" {
+		t.Fatalf("expected the upstream to agree on the client's protocol, got %q (%v)", line, err)
+	}
+}
@@ -26,6 +26,10 @@ To start the proxy server, provide a Root CA certificate and private key:
 	}
 	server.ListenAndServe()
 
+Or let Echo generate a root CA on first run and keep it in a directory:
+
+	e, err := echo.NewEchoWithCADir("", nil) // DefaultConfigDir
+
 # Plugins
 
 Add plugins to intercept and modify requests/responses:
@@ -63,6 +67,16 @@ Use [MockResponse] to return a static response:
 		},
 	})
 
+# Configuration File
+
+Options and declarative plugins can be loaded from a YAML or JSON file.
+The file is watched and the plugin set is swapped atomically on change;
+an invalid file is rejected with line numbers and the old set stays active:
+
+	e, err := echo.NewEchoFromConfig(certFile, keyFile, "echo.yaml")
+
+See [Config] for the format.
+
 [Whistle]: https://github.com/avwo/whistle
 */
 package echo
@@ -70,9 +84,13 @@ package echo
 import (
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ltaoo/echo/cert"
 )
@@ -93,6 +111,14 @@ type Echo struct {
 	wsHandler      *WebSocketHandler
 	httpHandler    *HTTPHandler
 	pluginLoader   *PluginLoader
+	options        Options
+
+	mu          sync.Mutex
+	configErr   error
+	configLists []string      // names of lists loaded by the last config
+	configStop  chan struct{} // stops the config watcher, nil when none runs
+	lists       map[string]*listWatcher
+	closers     []func()
 }
 
 // Options configures Echo behavior
@@ -102,7 +128,8 @@ type Options struct {
 	EnableBuiltinBypass bool
 
 	// InterceptOnlyMatched if true, only intercept requests that match a plugin.
-	// By default (false), all HTTPS traffic on port 443 is intercepted.
+	// By default (false), every CONNECT tunnel is sniffed: TLS is intercepted
+	// and cleartext HTTP inspected on any port, other protocols are relayed.
 	// When enabled, unmatched requests are tunneled directly without MITM.
 	InterceptOnlyMatched bool
 
@@ -111,6 +138,60 @@ type Options struct {
 	// When set, echo will forward all outbound requests through this proxy
 	// instead of connecting directly to targets.
 	UpstreamProxy string
+
+	// SniffTimeout is how long an intercepted CONNECT tunnel waits for the
+	// client to speak before it is relayed as-is, which is what protocols
+	// where the server speaks first need (default 500ms)
+	SniffTimeout time.Duration
+
+	// CertKeyType is the key algorithm of issued certificates (default
+	// cert.KeyECDSAP256). RSA keys are slower but work with old clients.
+	CertKeyType cert.KeyType
+	// CertTemplate customises each issued certificate: validity, SANs, key
+	// usages, AIA/CRL fields, subject. See cert.TemplateFunc. Certificates
+	// already in CertStoreDir are kept; empty its certs subdirectory after
+	// changing the template.
+	CertTemplate cert.TemplateFunc
+	// CAKeyPassword decrypts an encrypted CA key or PKCS#12 bundle
+	CAKeyPassword string
+
+	// CertStoreDir persists issued certificates and their key in a
+	// directory so they survive restarts. Empty keeps them in memory only.
+	CertStoreDir string
+	// CertCacheSize bounds the certificates kept in memory (default 1024)
+	CertCacheSize int
+
+	// WildcardCerts issues one "*.parent" certificate for all hosts under
+	// the same parent domain instead of one certificate per host
+	WildcardCerts bool
+	// PrewarmCerts issues certificates for the hostnames named by plugin
+	// patterns when the plugins are added, before the first connection
+	PrewarmCerts bool
+
+	// MimicUpstreamCert makes forged certificates copy the subject, SANs
+	// and validity window of the real server's certificate, fetched on the
+	// first connection to each host (through UpstreamProxy if set)
+	MimicUpstreamCert bool
+
+	// OnboardingHost is the host Echo answers itself instead of proxying
+	// (default DefaultOnboardingHost): http://echo.local/ serves a setup
+	// page, the root CA as ca.pem, ca.cer and ca.mobileconfig, and
+	// proxy.pac. Requests sent to Echo's port as to a web server get the
+	// same pages.
+	OnboardingHost string
+	// DisableOnboarding proxies requests for OnboardingHost like any other
+	DisableOnboarding bool
+
+	// LearnBypass makes Echo stop intercepting hosts whose clients keep
+	// rejecting the MITM certificate with bad_certificate, unknown_ca and
+	// similar alerts, as certificate-pinned apps do. Connections closed
+	// without an alert are not counted. See Echo.LearnedBypasses.
+	LearnBypass bool
+	// LearnBypassThreshold is the number of consecutive failed handshakes
+	// before a host is bypassed (default 3)
+	LearnBypassThreshold int
+	// LearnBypassTTL is how long a learned bypass lasts (default 24h)
+	LearnBypassTTL time.Duration
 }
 
 func NewEcho(certFile []byte, certKey []byte) (*Echo, error) {
@@ -119,7 +200,11 @@ func NewEcho(certFile []byte, certKey []byte) (*Echo, error) {
 
 // NewEchoWithOptions creates a new Echo instance with custom options
 func NewEchoWithOptions(certFile []byte, certKey []byte, opts *Options) (*Echo, error) {
-	caCert, caKey, err := cert.LoadRootCA(certFile, certKey)
+	var password string
+	if opts != nil {
+		password = opts.CAKeyPassword
+	}
+	caCert, caKey, chain, err := cert.LoadCA(certFile, certKey, password)
 	if err != nil {
 		return nil, err
 	}
@@ -129,17 +214,39 @@ func NewEchoWithOptions(certFile []byte, certKey []byte, opts *Options) (*Echo,
 	if err != nil {
 		return nil, err
 	}
-
-	// Initialize plugins
-	var plugins []*Plugin
-	if opts != nil && opts.EnableBuiltinBypass {
-		plugins = createBypassPlugins()
+	if len(chain) > 0 {
+		if err := certManager.SetCA(caCert, caKey, chain...); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.CertKeyType != "" {
+		if err := certManager.SetKeyType(opts.CertKeyType); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.CertStoreDir != "" {
+		store, err := cert.NewDirStore(opts.CertStoreDir, opts.CertCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := certManager.SetStore(store); err != nil {
+			return nil, err
+		}
+	} else if opts != nil && opts.CertCacheSize > 0 {
+		certManager.SetStore(cert.NewMemoryStore(opts.CertCacheSize))
+	}
+	if opts != nil && opts.CertTemplate != nil {
+		certManager.SetTemplate(opts.CertTemplate)
 	}
 
-	pluginLoader, err := NewPluginLoader(plugins)
+	// Initialize plugins
+	pluginLoader, err := NewPluginLoader(nil)
 	if err != nil {
 		return nil, err
 	}
+	if opts != nil && opts.EnableBuiltinBypass {
+		pluginLoader.SetGroup(builtinBypassGroup, createBypassPlugins())
+	}
 
 	// Initialize Proxy Handlers
 	var upstreamProxy string
@@ -154,14 +261,92 @@ func NewEchoWithOptions(certFile []byte, certKey []byte, opts *Options) (*Echo,
 		InterceptOnlyMatched: opts != nil && opts.InterceptOnlyMatched,
 		UpstreamProxy:        upstreamProxy,
 	}
+	if opts != nil {
+		connectHandler.SniffTimeout = opts.SniffTimeout
+	}
+	if opts != nil && opts.WildcardCerts {
+		certManager.EnableWildcard()
+	}
+	if opts != nil && opts.MimicUpstreamCert {
+		certManager.EnableMimic(func(addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return connectHandler.dialTarget(nil, host, port, "")
+		})
+	}
+	if opts != nil && opts.LearnBypass {
+		connectHandler.learner = newBypassLearner(opts.LearnBypassThreshold, opts.LearnBypassTTL)
+	}
 	wsHandler := &WebSocketHandler{PluginLoader: pluginLoader}
 
-	return &Echo{
+	e := &Echo{
 		connectHandler: connectHandler,
 		wsHandler:      wsHandler,
 		httpHandler:    httpHandler,
 		pluginLoader:   pluginLoader,
-	}, nil
+	}
+	if opts != nil {
+		e.options = *opts
+	}
+	return e, nil
+}
+
+// DefaultConfigDir returns the directory NewEchoWithCADir uses when given
+// none: "echo" under the user's config directory
+func DefaultConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "echo"), nil
+}
+
+// NewEchoWithCADir is NewEchoWithOptions with the root CA kept in dir
+// (DefaultConfigDir if empty). On first run a new CA is generated and saved
+// there, so every user gets their own instead of sharing a private key;
+// dir/rootCA.crt is the file to install on client devices.
+func NewEchoWithCADir(dir string, opts *Options) (*Echo, error) {
+	if dir == "" {
+		var err error
+		if dir, err = DefaultConfigDir(); err != nil {
+			return nil, err
+		}
+	}
+	caOpts := &cert.CAOptions{}
+	if opts != nil {
+		caOpts.KeyType = opts.CertKeyType
+	}
+	ca, created, err := cert.LoadOrCreateRootCA(dir, caOpts)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		log.Printf("[CA] Created root CA %q in %s, install %s on your devices", ca.Cert.Subject.CommonName, dir, cert.RootCACertFile)
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return nil, err
+	}
+	return NewEchoWithOptions(ca.CertPEM(), keyPEM, opts)
+}
+
+// RotateCA replaces the CA that signs intercepted connections without a
+// restart. The arguments are as for NewEchoWithOptions: certFile may hold
+// an intermediate CA followed by its chain, which is then served in every
+// handshake. Cached certificates are dropped; connections already
+// established keep the certificate they got.
+func (e *Echo) RotateCA(certFile, certKey []byte, password string) error {
+	caCert, caKey, chain, err := cert.LoadCA(certFile, certKey, password)
+	if err != nil {
+		return err
+	}
+	if err := e.connectHandler.CertManager.SetCA(caCert, caKey, chain...); err != nil {
+		return err
+	}
+	log.Printf("[CA] Now signing with %q", caCert.Subject.CommonName)
+	return nil
 }
 
 func (e *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -170,6 +355,11 @@ func (e *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		e.connectHandler.HandleTunnel(w, r)
 		return
 	}
+	// Requests for Echo itself: CA downloads and the setup page
+	if e.isOnboardingRequest(r) {
+		e.serveOnboarding(w, r)
+		return
+	}
 	// Handle WebSocket Upgrades (HTTP)
 	if IsWebSocketRequest(r) {
 		e.wsHandler.HandleUpgrade(w, r, false) // false = not secure (ws://)
@@ -180,6 +370,50 @@ func (e *Echo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 func (e *Echo) AddPlugin(plugin *Plugin) {
 	e.pluginLoader.AddPlugin(plugin)
+	if e.options.PrewarmCerts {
+		e.prewarmCerts([]*Plugin{plugin})
+	}
+}
+
+// prewarmCerts issues certificates ahead of time for the literal hosts of
+// plugins that will be intercepted
+func (e *Echo) prewarmCerts(plugins []*Plugin) {
+	var hosts []string
+	for _, p := range plugins {
+		if p.Bypass || p.routeOnly() {
+			continue
+		}
+		m, err := CompileMatch(p.Match)
+		if err != nil {
+			continue
+		}
+		if host := m.literalHost(); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) > 0 {
+		e.connectHandler.CertManager.Prewarm(hosts)
+	}
+}
+
+// Close stops background work such as config file watching.
+// It does not close listeners owned by the caller.
+func (e *Echo) Close() error {
+	e.mu.Lock()
+	closers := e.closers
+	e.closers = nil
+	e.mu.Unlock()
+	for _, fn := range closers {
+		fn()
+	}
+	return nil
+}
+
+// onClose registers fn to run on Close
+func (e *Echo) onClose(fn func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closers = append(e.closers, fn)
 }
 
 func SetLogEnabled(enabled bool) {
@@ -0,0 +1,171 @@
+package echo_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+	"github.com/ltaoo/echo/cert"
+)
+
+// testCA returns a throwaway root CA as PEM
+func testCA(t testing.TB) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Echo Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func newTestEcho(t testing.TB, opts *echo.Options) *echo.Echo {
+	t.Helper()
+	certPEM, keyPEM := testCA(t)
+	e, err := echo.NewEchoWithOptions(certPEM, keyPEM, opts)
+	if err != nil {
+		t.Fatalf("NewEchoWithOptions: %v", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestNewEchoWithCADir(t *testing.T) {
+	dir := t.TempDir()
+	first, err := echo.NewEchoWithCADir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	certPEM, err := os.ReadFile(filepath.Join(dir, "rootCA.crt"))
+	if err != nil {
+		t.Fatalf("expected the CA on disk: %v", err)
+	}
+
+	// The second run reuses the saved CA
+	second, err := echo.NewEchoWithCADir(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+	again, _ := os.ReadFile(filepath.Join(dir, "rootCA.crt"))
+	if !bytes.Equal(again, certPEM) {
+		t.Fatalf("expected the CA to be kept")
+	}
+}
+
+func TestRotateCA(t *testing.T) {
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match:     "api.example.com",
+		OnRequest: func(ctx *echo.Context) { ctx.Mock(http.StatusOK, nil, "ok") },
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	issuer := func() (string, int) {
+		t.Helper()
+		// A new client per call, so no connection is reused
+		res, err := proxyClient(proxy, "").Get("https://api.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].Issuer.CommonName, len(res.TLS.PeerCertificates)
+	}
+	if name, n := issuer(); name != "Echo Test CA" || n != 1 {
+		t.Fatalf("expected a leaf from the test CA, got %q with %d certificates", name, n)
+	}
+
+	// An intermediate signed by a root that stays offline, followed by the root
+	root, err := cert.GenerateRootCA(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := cert.GenerateKey(cert.KeyECDSAP256)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Echo Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root.Cert, key.Public(), root.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	chainPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), root.CertPEM()...)
+	if err := e.RotateCA(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), ""); err != nil {
+		t.Fatal(err)
+	}
+	if name, n := issuer(); name != "Echo Intermediate" || n != 2 {
+		t.Fatalf("expected a leaf from the intermediate with its chain, got %q with %d certificates", name, n)
+	}
+}
+
+func TestCertTemplateWithStoreDir(t *testing.T) {
+	certPEM, keyPEM := testCA(t)
+	dir := t.TempDir()
+	leafFor := func(opts *echo.Options) *x509.Certificate {
+		t.Helper()
+		opts.CertStoreDir = dir
+		e, err := echo.NewEchoWithOptions(certPEM, keyPEM, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Close()
+		e.AddPlugin(&echo.Plugin{Match: "api.example.com", MockResponse: &echo.MockResponse{StatusCode: 204}})
+		proxy := httptest.NewServer(e)
+		defer proxy.Close()
+		res, err := proxyClient(proxy, "").Get("https://api.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0]
+	}
+
+	template := func(hostname string, tmpl *x509.Certificate) error {
+		tmpl.Subject.Organization = []string{"Templated"}
+		return nil
+	}
+	first := leafFor(&echo.Options{CertTemplate: template})
+	if len(first.Subject.Organization) != 1 || first.Subject.Organization[0] != "Templated" {
+		t.Fatalf("expected the template to be applied, got %v", first.Subject)
+	}
+	if second := leafFor(&echo.Options{CertTemplate: template}); second.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("expected the persisted certificate to survive a restart with a template")
+	}
+}
@@ -0,0 +1,369 @@
+package echo
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Explanation describes what Echo would do with a request. It is returned
+// by Echo.Explain; String renders it for a terminal and it marshals to JSON.
+type Explanation struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+
+	// Connect is the CONNECT-stage decision, set for https and wss URLs
+	Connect *ConnectExplanation `json:"connect,omitempty"`
+
+	// Plugins are the request-level matches in the order their hooks run
+	Plugins []PluginExplanation `json:"plugins"`
+
+	Target    *TargetConfig   `json:"target,omitempty"`  // effective target, the last one wins
+	Targets   []*TargetConfig `json:"targets,omitempty"` // effective targets when the last plugin with any balances
+	TargetURL string          `json:"target_url,omitempty"`
+	Mock      *MockResponse   `json:"mock,omitempty"`  // static mock that answers the request
+	Local     string          `json:"local,omitempty"` // local file that answers the request, see MapLocal
+	Upstream  string          `json:"upstream"`        // "direct" or the upstream proxy URL
+
+	Notes []string `json:"notes,omitempty"`
+}
+
+// ConnectExplanation is the CONNECT-stage part of an Explanation
+type ConnectExplanation struct {
+	Host     string        `json:"host"`
+	Port     string        `json:"port"`
+	Action   ConnectAction `json:"action"`
+	Reason   string        `json:"reason"`
+	Upstream string        `json:"upstream,omitempty"` // set when the tunnel is relayed as-is
+}
+
+// PluginExplanation is one matched plugin
+type PluginExplanation struct {
+	Index      int             `json:"index"` // position in GetPlugins
+	Match      string          `json:"match"`
+	Reason     string          `json:"reason"`
+	Bypass     bool            `json:"bypass,omitempty"`
+	Direct     bool            `json:"direct,omitempty"`
+	Target     *TargetConfig   `json:"target,omitempty"`
+	Targets    []*TargetConfig `json:"targets,omitempty"`
+	Mock       bool            `json:"mock,omitempty"`
+	OnRequest  bool            `json:"on_request,omitempty"`
+	OnResponse bool            `json:"on_response,omitempty"`
+
+	OnTCPStream bool `json:"on_tcp_stream,omitempty"`
+	UpstreamTLS bool `json:"upstream_tls,omitempty"` // sets TLS options towards the server
+	Mirror      bool `json:"mirror,omitempty"`       // copies requests to a shadow target
+	MapLocal    bool `json:"map_local,omitempty"`    // answers from local files
+}
+
+// MarshalText renders the action as "mitm", "tunnel", "reject" or "redirect"
+func (a ConnectAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Explain reports how Echo would handle method and rawURL with the current
+// plugins and options: the CONNECT-stage decision, the matched plugins and
+// why they matched, the effective target or mock, and the upstream used.
+// Hooks are not run, so changes they would make are only noted.
+func (e *Echo) Explain(method, rawURL string) (*Explanation, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("explain: %q is not an absolute URL", rawURL)
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ex := &Explanation{Method: method, URL: u.String(), Plugins: []PluginExplanation{}}
+	scheme := strings.ToLower(u.Scheme)
+	secure := scheme == "https" || scheme == "wss"
+	websocket := scheme == "ws" || scheme == "wss"
+
+	if !secure && e.isOnboardingRequest(r) {
+		ex.Upstream = "none (served by Echo)"
+		ex.Notes = append(ex.Notes, "answered by Echo itself: this is the onboarding host")
+		return ex, nil
+	}
+
+	intercepted := true
+	if secure {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		d := e.connectHandler.decide(u.Hostname(), port, "")
+		ex.Connect = &ConnectExplanation{
+			Host:   u.Hostname(),
+			Port:   port,
+			Action: d.Action,
+			Reason: d.Reason,
+		}
+		for _, p := range d.Plugins {
+			if p.OnConnect != nil {
+				ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %q has an OnConnect hook that may change this decision", p.Match))
+			}
+		}
+		if d.Action == ConnectTunnel {
+			intercepted = false
+			ex.Connect.Upstream = "direct"
+			if e.connectHandler.useUpstream(u.Hostname(), port, "") {
+				ex.Connect.Upstream = upstreamName(e.connectHandler.UpstreamProxy)
+			}
+			ex.Notes = append(ex.Notes, "the tunnel is not decrypted, so request-level plugins do not run")
+		}
+	}
+
+	positions := make(map[*Plugin]int)
+	for i, p := range e.pluginLoader.GetPlugins() {
+		if _, ok := positions[p]; !ok {
+			positions[p] = i
+		}
+	}
+
+	// The client is unknown here, so plugins limited to some clients never
+	// match
+	for _, cp := range e.pluginLoader.snapshot().candidates(u.Hostname()) {
+		if len(cp.clients) > 0 && cp.matcher.MatchURL(u) {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) only applies to clients in %s and is left out", positions[cp.plugin], cp.plugin.Match, strings.Join(cp.plugin.ClientAddr, ", ")))
+		}
+	}
+
+	mocked := false
+	var shadow *mirror
+	for _, cp := range e.pluginLoader.matchRequest(r) {
+		p := cp.plugin
+		ex.Plugins = append(ex.Plugins, PluginExplanation{
+			Index:      positions[p],
+			Match:      p.Match,
+			Reason:     cp.describe(),
+			Bypass:     p.Bypass,
+			Direct:     p.Direct,
+			Target:     p.Target,
+			Targets:    p.Targets,
+			Mock:       p.MockResponse != nil,
+			OnRequest:  p.OnRequest != nil,
+			OnResponse: p.OnResponse != nil,
+
+			OnTCPStream: p.OnTCPStream != nil,
+			UpstreamTLS: p.UpstreamTLS != nil,
+			Mirror:      p.Mirror != nil,
+			MapLocal:    p.MapLocal != nil,
+		})
+		if !intercepted || mocked {
+			continue
+		}
+		if p.OnRequest != nil {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) has an OnRequest hook that may change the request or mock it", positions[p], p.Match))
+		}
+		if p.MockResponse != nil && !websocket {
+			ex.Mock = p.MockResponse
+			mocked = true
+			ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) answers with a mock; later plugins do not run", positions[p], p.Match))
+			continue
+		}
+		if cp.local != nil && !websocket {
+			if name, redirect, ok := cp.local.lookup(r.URL.Path); ok {
+				mocked = true
+				switch {
+				case name == "":
+					ex.Local = "(no file)"
+					ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) answers from %s, where no file matches: 404", positions[p], p.Match, cp.local.root))
+				case redirect:
+					ex.Local = name
+					ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) redirects to the directory with a trailing slash", positions[p], p.Match))
+				default:
+					ex.Local = name
+					ex.Notes = append(ex.Notes, fmt.Sprintf("plugin %d (%q) answers with a local file; later plugins do not run", positions[p], p.Match))
+				}
+				continue
+			}
+		}
+		if p.Target != nil {
+			ex.Target, ex.Targets = p.Target, nil
+		}
+		if cp.balancer != nil {
+			ex.Target, ex.Targets = nil, p.Targets
+		}
+		if cp.mirror != nil && !websocket {
+			shadow = cp.mirror
+		}
+	}
+	if shadow != nil && ex.Mock == nil && ex.Local == "" {
+		ex.Notes = append(ex.Notes, fmt.Sprintf("a copy is sent to %s and its response compared", shadow.target.label()))
+	}
+
+	if !intercepted {
+		ex.Upstream = ex.Connect.Upstream
+		return ex, nil
+	}
+	if ex.Mock != nil {
+		ex.Target, ex.Targets = nil, nil
+		ex.Upstream = "none (mocked)"
+		return ex, nil
+	}
+	if ex.Local != "" {
+		ex.Target, ex.Targets = nil, nil
+		ex.Upstream = "none (local file)"
+		return ex, nil
+	}
+	if ex.Targets != nil {
+		ex.Notes = append(ex.Notes, fmt.Sprintf("one of %d targets is chosen per request", len(ex.Targets)))
+		ex.Upstream = "depends on the chosen target"
+		return ex, nil
+	}
+
+	forward := *r.URL
+	if ex.Target != nil {
+		forward.Scheme = ex.Target.httpProtocol()
+		forward.Host = ex.Target.forwardHost(u.Host)
+		ex.Target.rewritePath(&forward)
+		ex.TargetURL = forward.String()
+		if host := ex.Target.hostHeader(u.Host); host != "" {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("sent with Host: %s", host))
+		}
+		if sni := ex.Target.serverName(ex.Target.hostHeader(u.Host)); sni != "" && forward.Scheme == "https" {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("TLS server name %s", sni))
+		}
+		if ex.Target.Dial != "" {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("connects to %s", ex.Target.Dial))
+			ex.Upstream = "direct"
+			return ex, nil
+		}
+		if ex.Target.local() {
+			ex.Notes = append(ex.Notes, fmt.Sprintf("served by the %s without a TCP connection", ex.Target.label()))
+			ex.Upstream = "none (" + ex.Target.label() + ")"
+			return ex, nil
+		}
+	}
+	if websocket {
+		ex.Upstream = "direct"
+		return ex, nil
+	}
+	ex.Upstream = "direct"
+	if proxy := e.httpHandler.Transport.Proxy; proxy != nil {
+		fr := r.Clone(r.Context())
+		fr.URL = &forward
+		if proxyURL, err := proxy(fr); err == nil && proxyURL != nil {
+			ex.Upstream = proxyURL.String()
+		}
+	}
+	if e.httpHandler.UpstreamProxy != "" && ex.Upstream != "direct" {
+		ex.Upstream += " (falls back to direct)"
+	}
+	return ex, nil
+}
+
+// upstreamName describes a configured upstream proxy
+func upstreamName(proxy string) string {
+	if proxy == "" {
+		return "direct"
+	}
+	return proxy + " (falls back to direct)"
+}
+
+// describe explains why a plugin matched: its pattern and conditions
+func (cp *compiledPlugin) describe() string {
+	parts := []string{cp.matcher.String()}
+	p := cp.plugin
+	if len(p.Methods) > 0 {
+		parts = append(parts, "method in "+strings.Join(cp.methods, "/"))
+	}
+	for k, v := range p.Query {
+		parts = append(parts, describeValue("query "+k, v))
+	}
+	for k, v := range p.Headers {
+		parts = append(parts, describeValue("header "+k, v))
+	}
+	if len(p.ClientAddr) > 0 {
+		parts = append(parts, "client in "+strings.Join(p.ClientAddr, ", "))
+	}
+	if p.Response != nil {
+		parts = append(parts, "OnResponse limited by response conditions")
+	}
+	return strings.Join(parts, "; ")
+}
+
+func describeValue(name, v string) string {
+	if v == "" {
+		return name + " present"
+	}
+	return fmt.Sprintf("%s matches %q", name, v)
+}
+
+// String renders the explanation for a terminal
+func (ex *Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", ex.Method, ex.URL)
+	if c := ex.Connect; c != nil {
+		fmt.Fprintf(&b, "CONNECT %s:%s -> %s (%s)\n", c.Host, c.Port, c.Action, c.Reason)
+	}
+	if len(ex.Plugins) == 0 {
+		b.WriteString("No plugin matched\n")
+	}
+	for _, p := range ex.Plugins {
+		var hooks []string
+		if p.Bypass {
+			hooks = append(hooks, "bypass")
+		}
+		if p.Direct {
+			hooks = append(hooks, "direct")
+		}
+		if p.Target != nil {
+			hooks = append(hooks, "target "+p.Target.label())
+		}
+		if len(p.Targets) > 0 {
+			labels := make([]string, len(p.Targets))
+			for i, t := range p.Targets {
+				labels[i] = t.label()
+			}
+			hooks = append(hooks, "targets "+strings.Join(labels, " | "))
+		}
+		if p.Mock {
+			hooks = append(hooks, "mock")
+		}
+		if p.UpstreamTLS {
+			hooks = append(hooks, "upstream TLS")
+		}
+		if p.Mirror {
+			hooks = append(hooks, "mirror")
+		}
+		if p.MapLocal {
+			hooks = append(hooks, "map local")
+		}
+		if p.OnRequest {
+			hooks = append(hooks, "OnRequest")
+		}
+		if p.OnResponse {
+			hooks = append(hooks, "OnResponse")
+		}
+		if p.OnTCPStream {
+			hooks = append(hooks, "OnTCPStream")
+		}
+		fmt.Fprintf(&b, "  #%d %q: %s", p.Index, p.Match, p.Reason)
+		if len(hooks) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(hooks, ", "))
+		}
+		b.WriteString("\n")
+	}
+	switch {
+	case ex.Mock != nil:
+		fmt.Fprintf(&b, "Mock: %d\n", ex.Mock.StatusCode)
+	case ex.Local != "":
+		fmt.Fprintf(&b, "Local: %s\n", ex.Local)
+	case ex.TargetURL != "":
+		fmt.Fprintf(&b, "Target: %s\n", ex.TargetURL)
+	}
+	fmt.Fprintf(&b, "Upstream: %s\n", ex.Upstream)
+	for _, n := range ex.Notes {
+		fmt.Fprintf(&b, "Note: %s\n", n)
+	}
+	return b.String()
+}
@@ -0,0 +1,72 @@
+package echo_test
+
+import (
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestExplain(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{InterceptOnlyMatched: true})
+	e.AddPlugin(&echo.Plugin{Match: "pinned.example.com", Bypass: true})
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com", Target: &echo.TargetConfig{Host: "127.0.0.1", Port: 3000}})
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com/v2/", Target: &echo.TargetConfig{Host: "127.0.0.1", Port: 3002}})
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com/mock", MockResponse: &echo.MockResponse{StatusCode: 204}})
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com/assets/", MapLocal: &echo.MapLocal{Path: "dist"}})
+
+	t.Run("last target wins", func(t *testing.T) {
+		ex, err := e.Explain("GET", "https://api.example.com/v2/users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Connect == nil || ex.Connect.Action != echo.ConnectMITM {
+			t.Fatalf("expected MITM, got %+v", ex.Connect)
+		}
+		if len(ex.Plugins) != 2 {
+			t.Fatalf("expected 2 plugins, got %d:\n%s", len(ex.Plugins), ex)
+		}
+		if ex.TargetURL != "http://127.0.0.1:3002/v2/users" {
+			t.Fatalf("unexpected target %q", ex.TargetURL)
+		}
+	})
+
+	t.Run("mock", func(t *testing.T) {
+		ex, err := e.Explain("GET", "http://api.example.com/mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Mock == nil || ex.Mock.StatusCode != 204 || ex.Target != nil {
+			t.Fatalf("expected mock only:\n%s", ex)
+		}
+	})
+
+	t.Run("map local", func(t *testing.T) {
+		ex, err := e.Explain("GET", "http://api.example.com/assets/app.js")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Local == "" || ex.Target != nil || ex.Upstream != "none (local file)" {
+			t.Fatalf("expected a local file only:\n%s", ex)
+		}
+	})
+
+	t.Run("bypass", func(t *testing.T) {
+		ex, err := e.Explain("GET", "https://pinned.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Connect.Action != echo.ConnectTunnel || ex.Upstream != "direct" {
+			t.Fatalf("expected direct tunnel:\n%s", ex)
+		}
+	})
+
+	t.Run("intercept only", func(t *testing.T) {
+		ex, err := e.Explain("GET", "https://other.example.org/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ex.Connect.Action != echo.ConnectTunnel {
+			t.Fatalf("expected tunnel:\n%s", ex)
+		}
+	})
+}
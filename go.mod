@@ -5,6 +5,11 @@ go 1.20
 require (
 	github.com/andybalholm/brotli v1.0.4
 	github.com/klauspost/compress v1.15.15
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
-require golang.org/x/sys v0.28.0 // indirect
+require golang.org/x/text v0.13.0 // indirect
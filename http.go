@@ -2,12 +2,14 @@ package echo
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -17,6 +19,117 @@ type HTTPHandler struct {
 	Transport         *http.Transport
 	FallbackTransport *http.Transport // 直连，用于上游代理不可用时 fallback
 	UpstreamProxy     string
+
+	derivedMu  sync.Mutex
+	derived    map[transportKey][2]*http.Transport
+	derivedFor *pluginSet // plugin set derived was last pruned for
+	mirrors    mirrorLog
+}
+
+// transportKey identifies the transports derived from Transport and
+// FallbackTransport for a target's connection settings
+type transportKey struct {
+	tls        *upstreamTLS
+	serverName string // overrides the one in tls
+	dial       string
+	unix       string
+	handler    *TargetConfig // Handler target
+}
+
+// transports returns the transports for key, created on first use
+func (h *HTTPHandler) transports(key transportKey) (transport, fallback *http.Transport) {
+	if key == (transportKey{}) {
+		return h.Transport, h.FallbackTransport
+	}
+	h.derivedMu.Lock()
+	defer h.derivedMu.Unlock()
+	h.pruneDerived()
+	if pair, ok := h.derived[key]; ok {
+		return pair[0], pair[1]
+	}
+	derive := func(base *http.Transport) *http.Transport {
+		if base == nil {
+			return nil
+		}
+		tr := base.Clone()
+		if key.tls != nil {
+			// ServerName stays empty unless overridden, so the transport
+			// fills in the host of each request
+			tr.TLSClientConfig = key.tls.config.Clone()
+			tr.TLSClientConfig.ServerName = key.tls.serverName
+		}
+		if key.serverName != "" {
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.ServerName = key.serverName
+		}
+		if key.dial != "" {
+			dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			tr.Proxy = nil
+			tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, key.dial)
+			}
+		}
+		if key.unix != "" {
+			dialer := &net.Dialer{}
+			tr.Proxy = nil
+			tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", key.unix)
+			}
+		}
+		if key.handler != nil {
+			tr.Proxy = nil
+			tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return key.handler.dialLocal(ctx)
+			}
+		}
+		return tr
+	}
+	pair := [2]*http.Transport{derive(h.Transport), derive(h.FallbackTransport)}
+	if h.derived == nil {
+		h.derived = make(map[transportKey][2]*http.Transport)
+	}
+	h.derived[key] = pair
+	return pair[0], pair[1]
+}
+
+// pruneDerived drops the transports of TLS settings and Handler targets
+// that are gone from the plugins, closing their idle connections. Plugins
+// are compiled anew on every reload, so without this each reload would
+// leave a pair of transports behind. Called with derivedMu held.
+func (h *HTTPHandler) pruneDerived() {
+	if h.PluginLoader == nil {
+		return
+	}
+	set := h.PluginLoader.snapshot()
+	if set == h.derivedFor {
+		return
+	}
+	h.derivedFor = set
+	live := make(map[interface{}]bool)
+	for _, cp := range set.compiled {
+		if cp.tls != nil {
+			live[cp.tls] = true
+		}
+		live[cp.plugin.Target] = true
+		for _, t := range cp.plugin.Targets {
+			live[t] = true
+		}
+		if cp.mirror != nil {
+			live[cp.mirror.target] = true
+		}
+	}
+	for key, pair := range h.derived {
+		if (key.tls != nil && !live[key.tls]) || (key.handler != nil && !live[key.handler]) {
+			delete(h.derived, key)
+			for _, tr := range pair {
+				if tr != nil {
+					tr.CloseIdleConnections()
+				}
+			}
+		}
+	}
 }
 
 // NewHTTPHandler creates a new HTTP handler with a custom transport
@@ -36,6 +149,9 @@ func NewHTTPHandlerWithUpstream(loader *PluginLoader, upstreamProxy string) *HTT
 			// 自定义 proxy 函数，带 fallback 到直连
 			proxyURL := proxyURL
 			proxyFunc = func(req *http.Request) (*url.URL, error) {
+				if loader != nil && loader.direct(req.URL.Hostname(), req.URL.Port(), req.RemoteAddr) {
+					return nil, nil
+				}
 				return proxyURL, nil
 			}
 			log.Printf("[UpstreamProxy] Using upstream proxy: %s (with fallback to direct)", upstreamProxy)
@@ -96,51 +212,76 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[HTTP] %s %s (Host: %s)", r.Method, r.URL.String(), hostname)
 
 	// Find all matching plugins
-	matched_plugins := h.PluginLoader.MatchPluginsForRequest(r)
+	matched_plugins := h.PluginLoader.matchRequest(r)
+
+	// Plugins that want to see the response. Responses no plugin inspects
+	// are streamed through without buffering.
+	var response_plugins []*compiledPlugin
+	for _, cp := range matched_plugins {
+		if cp.plugin.OnResponse != nil {
+			response_plugins = append(response_plugins, cp)
+		}
+	}
 
 	// Create Plugin Context
-	ctx := &Context{Req: r}
+	ctx := &Context{Req: r, tunnel: tunnelFromContext(r.Context())}
 
-	// Apply OnRequest hooks in order; last Target wins
+	// Apply OnRequest hooks in order; last Target(s) and TLS settings win
+	var target_plugin *compiledPlugin
 	var selected_target *TargetConfig
+	var selected_balancer *balancer
+	var selected_tls *upstreamTLS
+	var selected_mirror *mirror
+	var shadow *http.Request
+	var captured func(*mirrorResponse) // set while mirroring
+	var key transportKey
 	if len(matched_plugins) > 0 {
 		log.Printf("[HTTP] %d plugin(s) matched for %s", len(matched_plugins), hostname)
-		for _, p := range matched_plugins {
+		for _, cp := range matched_plugins {
+			p := cp.plugin
 			if p.OnRequest != nil {
 				p.OnRequest(ctx)
-				if mockResp := ctx.GetMockResponse(); mockResp != nil {
-					log.Printf("[PLUGIN] Returning direct response for %s", path)
-					h.sendMockResponse(w, mockResp)
-					return
-				}
 			}
-			if p.Target != nil {
-				selected_target = p.Target
+			mockResp := ctx.GetMockResponse()
+			if mockResp == nil {
+				mockResp = p.MockResponse
+			}
+			if mockResp != nil {
+				log.Printf("[PLUGIN] Returning direct response for %s", path)
+				h.sendMockResponse(w, mockResp)
+				return
+			}
+			if cp.local != nil && cp.local.serve(w, r) {
+				return
 			}
+			if p.Target != nil || cp.balancer != nil {
+				target_plugin = cp
+			}
+			if cp.tls != nil {
+				selected_tls = cp.tls
+			}
+			if cp.mirror != nil {
+				selected_mirror = cp.mirror
+			}
+		}
+		if target_plugin != nil {
+			selected_target, selected_balancer = target_plugin.target(r)
+		}
+		if selected_mirror != nil {
+			// Copied before retargeting; the shadow gets its own target
+			shadow = r.Clone(context.Background())
 		}
 		if selected_target != nil {
-			targetProtocol := selected_target.Protocol
-			if targetProtocol == "" {
-				if selected_target.Port == 443 {
-					targetProtocol = "https"
-				} else {
-					targetProtocol = "http"
-				}
-			}
-
-			// Construct target URL for logging
-			targetURL := targetProtocol + "://" + selected_target.GetHostPort() + path
-			log.Printf("[PLUGIN] Forwarding %s -> %s", hostname, targetURL)
-
-			r.URL.Scheme = targetProtocol
-			r.URL.Host = selected_target.GetHostPort()
-			r.Host = selected_target.GetHostPort()
+			key = forwardTo(r, selected_target)
+			log.Printf("[PLUGIN] Forwarding %s -> %s (Host: %s)", hostname, r.URL.String(), r.Host)
 		}
 	}
 
 	// Create client with custom transport
+	key.tls = selected_tls
+	transport, fallbackTransport := h.transports(key)
 	client := &http.Client{
-		Transport: h.Transport,
+		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -149,8 +290,9 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	// Create new request
 	// We need to read body if present
 	var bodyReader io.Reader
+	var bodyBytes []byte
 	if r.Body != nil {
-		bodyBytes, _ := io.ReadAll(r.Body)
+		bodyBytes, _ = io.ReadAll(r.Body)
 		r.Body.Close()
 		bodyReader = bytes.NewReader(bodyBytes)
 		// Re-assign body to request for potential reuse if we weren't creating a new request
@@ -163,24 +305,42 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if selected_target != nil {
+		proxyReq.Host = r.Host
+	}
+
+	// Mirror to the shadow target; it gets the primary response once the
+	// client has it
+	if shadow != nil {
+		var mirrored *mirrorResponse
+		primary := h.startMirror(selected_mirror, shadow, bodyBytes, selected_tls)
+		defer func() { primary <- mirrored }()
+		captured = func(res *mirrorResponse) { mirrored = res }
+	}
+
 	// Copy headers
 	CopyHeader(proxyReq.Header, r.Header)
 	DelHopHeaders(proxyReq.Header)
+	// For the ClientAddr of Direct plugins, checked by the Proxy func
+	proxyReq.RemoteAddr = r.RemoteAddr
 
 	// Send request with fallback to direct when upstream proxy fails
 	var resp *http.Response
 	sendErr := error(nil)
 	resp, sendErr = client.Do(proxyReq)
-	if sendErr != nil && h.UpstreamProxy != "" && h.FallbackTransport != nil {
+	if sendErr != nil && h.UpstreamProxy != "" && fallbackTransport != nil {
 		log.Printf("[UpstreamProxy] Failed, falling back to direct: %v", sendErr)
 		fallbackClient := &http.Client{
-			Transport: h.FallbackTransport,
+			Transport: fallbackTransport,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 		}
 		resp, sendErr = fallbackClient.Do(proxyReq)
 	}
+	if selected_balancer != nil {
+		selected_balancer.report(selected_target, sendErr == nil && healthyStatus(resp.StatusCode))
+	}
 	if sendErr != nil {
 		log.Printf("[HTTP Error] %v", sendErr)
 		http.Error(w, sendErr.Error(), http.StatusBadGateway)
@@ -188,13 +348,30 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
-	// Apply OnResponse hooks of all matched plugins in order
-	if len(matched_plugins) > 0 {
+	// The shadow is compared with the response as the server sent it, so
+	// capture it before OnResponse hooks edit it
+	var original *mirrorResponse
+	var originalBody captureBuffer
+	var upstreamBody io.Reader
+	if captured != nil {
+		original = &mirrorResponse{status: resp.StatusCode, header: resp.Header.Clone()}
+		DelHopHeaders(original.header)
+		upstreamBody = io.TeeReader(resp.Body, &originalBody)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{upstreamBody, resp.Body}
+	}
+
+	// Apply OnResponse hooks in order, skipping plugins whose response
+	// conditions do not hold
+	if len(response_plugins) > 0 {
 		ctx.Res = resp
-		for _, p := range matched_plugins {
-			if p.OnResponse != nil {
-				p.OnResponse(ctx)
+		for _, cp := range response_plugins {
+			if !cp.response.match(resp) {
+				continue
 			}
+			cp.plugin.OnResponse(ctx)
 		}
 	}
 
@@ -204,7 +381,35 @@ func (h *HTTPHandler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(resp.StatusCode)
 
 	// Copy response body
-	io.Copy(w, resp.Body)
+	if captured == nil {
+		io.Copy(w, resp.Body)
+		return
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return
+	}
+	// A hook may have replaced the body without reading all of it
+	if _, err := io.Copy(io.Discard, io.LimitReader(upstreamBody, mirrorBodyLimit+1)); err == nil {
+		original.body, original.truncated = originalBody.Bytes(), originalBody.truncated
+		captured(original)
+	}
+}
+
+// forwardTo points req at t and returns the transport settings for it
+func forwardTo(req *http.Request, t *TargetConfig) transportKey {
+	host := t.hostHeader(req.Host)
+	req.URL.Scheme = t.httpProtocol()
+	req.URL.Host = t.forwardHost(req.URL.Host)
+	t.rewritePath(req.URL)
+	req.Host = req.URL.Host
+	if host != "" {
+		req.Host = host
+	}
+	key := transportKey{serverName: t.serverName(host), dial: t.Dial, unix: t.Unix}
+	if t.Handler != nil {
+		key.handler = t
+	}
+	return key
 }
 
 // forwardDirect forwards requests directly without MITM for sensitive services
@@ -254,6 +459,8 @@ func (h *HTTPHandler) forwardDirect(w http.ResponseWriter, r *http.Request) {
 	// Copy headers
 	CopyHeader(proxyReq.Header, r.Header)
 	DelHopHeaders(proxyReq.Header)
+	// For the ClientAddr of Direct plugins, checked by the Proxy func
+	proxyReq.RemoteAddr = r.RemoteAddr
 
 	// Send request
 	resp, err := client.Do(proxyReq)
@@ -0,0 +1,228 @@
+package echo_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+// proxyGet sends a GET for target through an HTTPHandler with the plugins
+func proxyGet(t *testing.T, target string, plugins ...*echo.Plugin) *http.Response {
+	t.Helper()
+	loader, err := echo.NewPluginLoader(plugins)
+	if err != nil {
+		t.Fatalf("NewPluginLoader: %v", err)
+	}
+	handler := echo.NewHTTPHandler(loader)
+	r := httptest.NewRequest("GET", target, nil)
+	w := httptest.NewRecorder()
+	handler.HandleRequest(w, r)
+	return w.Result()
+}
+
+func TestOnResponseConditions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, "<html>hello</html>")
+		case "/missing":
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "<html>missing</html>")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"hello":true}`)
+		}
+	}))
+	defer backend.Close()
+
+	rewrite := func(limit int64) *echo.Plugin {
+		return &echo.Plugin{
+			Match:    "*",
+			Response: &echo.ResponseMatch{Status: "2xx", ContentType: []string{"text/*"}, MaxBodySize: limit},
+			OnResponse: func(ctx *echo.Context) {
+				body, _ := ctx.GetResponseBody()
+				ctx.SetResponseBody(strings.ToUpper(body))
+			},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		limit    int64
+		expected string
+	}{
+		{"matching html", "/page", 0, "<HTML>HELLO</HTML>"},
+		{"content type mismatch", "/data", 0, `{"hello":true}`},
+		{"status mismatch", "/missing", 0, "<html>missing</html>"},
+		{"body too large", "/page", 4, "<html>hello</html>"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := proxyGet(t, backend.URL+c.path, rewrite(c.limit))
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != c.expected {
+				t.Fatalf("expected %q, got %q", c.expected, body)
+			}
+		})
+	}
+}
+
+func TestTargetRewrites(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().(*net.TCPAddr)
+
+	cases := []struct {
+		name     string
+		target   echo.TargetConfig
+		url      string
+		expected string
+	}{
+		{"default", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port}, "http://api.example.com/v1", fmt.Sprintf("127.0.0.1:%d /v1", addr.Port)},
+		{"host header", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port, HostHeader: "front.example.com"}, "http://api.example.com/v1", "front.example.com /v1"},
+		{"preserve host", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port, PreserveHost: true}, "http://api.example.com/v1", "api.example.com /v1"},
+		{"dial", echo.TargetConfig{Host: "staging.example.com", Port: 80, Dial: addr.String()}, "http://api.example.com/v1", "staging.example.com:80 /v1"},
+		{"strip prefix", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port, StripPrefix: "/api"}, "http://api.example.com/api/v1?q=1", fmt.Sprintf("127.0.0.1:%d /v1?q=1", addr.Port)},
+		{"strip whole segments", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port, StripPrefix: "/api"}, "http://api.example.com/apix", fmt.Sprintf("127.0.0.1:%d /apix", addr.Port)},
+		{"replace prefix", echo.TargetConfig{Host: "127.0.0.1", Port: addr.Port, StripPrefix: "/api/", PathPrefix: "/staging"}, "http://api.example.com/api", fmt.Sprintf("127.0.0.1:%d /staging/", addr.Port)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target := c.target
+			res := proxyGet(t, c.url, &echo.Plugin{Match: "api.example.com", Target: &target})
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != c.expected {
+				t.Fatalf("expected %q, got %d %q", c.expected, res.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestTargetServerName(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName+" "+r.Host)
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().(*net.TCPAddr)
+	roots := &echo.UpstreamTLS{RootCAs: []string{writePEM(t, backend.Certificate())}}
+
+	// Staging server behind virtual hosting: SNI and Host stay example.com
+	res := proxyGet(t, "https://example.com/", &echo.Plugin{
+		Match:       "example.com",
+		Target:      &echo.TargetConfig{Protocol: "https", Host: "127.0.0.1", Port: addr.Port, PreserveHost: true},
+		UpstreamTLS: roots,
+	})
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "example.com example.com" {
+		t.Fatalf("expected SNI and Host example.com, got %d %q", res.StatusCode, body)
+	}
+
+	// Domain fronting: SNI of one name, Host of another
+	res = proxyGet(t, "https://hidden.test/", &echo.Plugin{
+		Match:       "hidden.test",
+		Target:      &echo.TargetConfig{Protocol: "https", Host: "127.0.0.1", Port: addr.Port, HostHeader: "hidden.test", ServerName: "example.com"},
+		UpstreamTLS: roots,
+	})
+	body, _ = io.ReadAll(res.Body)
+	if string(body) != "example.com hidden.test" {
+		t.Fatalf("expected SNI example.com and Host hidden.test, got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestLocalTargets(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host+r.URL.Path)
+	})
+	upper := func(target *echo.TargetConfig) *echo.Plugin {
+		return &echo.Plugin{
+			Match:  "api.example.com",
+			Target: target,
+			OnResponse: func(ctx *echo.Context) {
+				body, _ := ctx.GetResponseBody()
+				ctx.SetResponseBody(strings.ToUpper(body))
+			},
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "dev.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	defer server.Close()
+
+	cases := []struct {
+		name   string
+		target *echo.TargetConfig
+	}{
+		{"handler", &echo.TargetConfig{Handler: handler}},
+		{"unix socket", &echo.TargetConfig{Unix: socket}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := proxyGet(t, "http://api.example.com/v1", upper(c.target))
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != "HELLO FROM API.EXAMPLE.COM/V1" {
+				t.Fatalf("expected the local target's response through OnResponse, got %d %q", res.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandlerTarget(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		line, _ := buf.ReadString('\n')
+		buf.WriteString("echo " + line)
+		buf.Flush()
+	})
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{{
+		Match:  "ws.example.com",
+		Target: &echo.TargetConfig{Handler: backend},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &echo.WebSocketHandler{PluginLoader: loader}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleUpgrade(w, r, false)
+	}))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: ws.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %v %v", res, err)
+	}
+	fmt.Fprint(conn, "ping\n")
+	if line, _ := reader.ReadString('\n'); line != "echo ping\n" {
+		t.Fatalf("expected the handler to echo, got %q", line)
+	}
+}
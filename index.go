@@ -0,0 +1,110 @@
+package echo
+
+import (
+	"sort"
+	"strings"
+)
+
+// hostIndex finds the plugins whose host pattern can match a hostname
+// without testing every plugin.
+//
+// Exact, domain and "*.suffix" patterns live in a trie keyed by reversed
+// domain labels ("api.example.com" -> com, example, api), so a lookup costs
+// one step per label of the hostname regardless of how many rules exist.
+// Everything else (regex, CIDR, substring, "*" and other globs) is kept in a
+// fallback list that is checked on every lookup.
+type hostIndex struct {
+	root     *trieNode
+	fallback []int // positions in pluginSet.compiled
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	exact    []int // the host itself
+	domain   []int // the host and all subdomains
+	wildcard []int // strict subdomains only ("*.host")
+}
+
+func newHostIndex(compiled []*compiledPlugin) *hostIndex {
+	idx := &hostIndex{root: &trieNode{}}
+	for i, cp := range compiled {
+		idx.add(i, cp.matcher)
+	}
+	return idx
+}
+
+func (idx *hostIndex) add(pos int, m *Matcher) {
+	if m.Kind == MatchRegex || m.Kind == MatchAny {
+		idx.fallback = append(idx.fallback, pos)
+		return
+	}
+	h := m.host
+	switch h.kind {
+	case MatchExact:
+		n := idx.node(h.value)
+		n.exact = append(n.exact, pos)
+	case MatchDomain:
+		n := idx.node(h.value)
+		n.domain = append(n.domain, pos)
+	case MatchGlob:
+		suffix := strings.TrimPrefix(h.value, "*.")
+		if suffix == h.value || strings.Contains(suffix, "*") {
+			idx.fallback = append(idx.fallback, pos)
+			return
+		}
+		n := idx.node(suffix)
+		n.wildcard = append(n.wildcard, pos)
+	default:
+		idx.fallback = append(idx.fallback, pos)
+	}
+}
+
+// node returns the trie node for host, creating the path as needed
+func (idx *hostIndex) node(host string) *trieNode {
+	n := idx.root
+	labels := strings.Split(host, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*trieNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &trieNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// lookup returns the positions of candidate plugins for hostname in
+// ascending order. Candidates still need a full match.
+func (idx *hostIndex) lookup(hostname string) []int {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	candidates := append([]int(nil), idx.fallback...)
+
+	n := idx.root
+	rest := hostname
+	for rest != "" && n.children != nil {
+		label := rest
+		if i := strings.LastIndexByte(rest, '.'); i != -1 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			rest = ""
+		}
+		child, ok := n.children[label]
+		if !ok {
+			break
+		}
+		n = child
+		candidates = append(candidates, n.domain...)
+		if rest != "" {
+			candidates = append(candidates, n.wildcard...)
+		} else {
+			candidates = append(candidates, n.exact...)
+		}
+	}
+
+	sort.Ints(candidates)
+	return candidates
+}
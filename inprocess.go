@@ -0,0 +1,59 @@
+package echo
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// local reports whether t is reached without the network: a Unix socket
+// or an in-process Handler
+func (t *TargetConfig) local() bool {
+	return t.Unix != "" || t.Handler != nil
+}
+
+// dialLocal connects to a Unix socket or Handler target
+func (t *TargetConfig) dialLocal(ctx context.Context) (net.Conn, error) {
+	if t.Handler != nil {
+		return dialHandler(t.Handler), nil
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", t.Unix)
+}
+
+// label names t for logs and explanations
+func (t *TargetConfig) label() string {
+	switch {
+	case t.Handler != nil:
+		return "in-process handler"
+	case t.Unix != "":
+		return "unix socket " + t.Unix
+	default:
+		return t.GetHostPort()
+	}
+}
+
+// forwardHost returns the host:port to put in forwarded URLs. Local
+// targets without a Host keep the original one, so the handler or socket
+// server sees the host the client asked for.
+func (t *TargetConfig) forwardHost(original string) string {
+	if t.Host == "" && t.local() {
+		return original
+	}
+	return t.GetHostPort()
+}
+
+// dialHandler connects to handler over an in-memory pipe. Each connection
+// gets its own http.Server, which stops accepting after it and lets the
+// connection run until either side closes it, so upgrades and streaming
+// responses behave as they would over a socket.
+func dialHandler(handler http.Handler) net.Conn {
+	client, server := net.Pipe()
+	l := newConnListener()
+	go (&http.Server{Handler: handler}).Serve(l)
+	go func() {
+		l.push(server)
+		l.Close()
+	}()
+	return client
+}
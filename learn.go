@@ -0,0 +1,217 @@
+package echo
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLearnThreshold = 3
+	defaultLearnTTL       = 24 * time.Hour
+)
+
+// LearnedBypass is a host Echo stopped intercepting because clients kept
+// rejecting its certificate, which usually means certificate pinning
+type LearnedBypass struct {
+	Host      string    `json:"host"`
+	Failures  int       `json:"failures"`
+	Reason    string    `json:"reason"` // last failure, e.g. "bad_certificate alert"
+	LearnedAt time.Time `json:"learned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// bypassLearner counts MITM handshake failures per host and bypasses hosts
+// that reach the threshold until the entry expires
+type bypassLearner struct {
+	threshold int
+	ttl       time.Duration
+
+	mu       sync.Mutex
+	failures map[string]int
+	learned  map[string]*LearnedBypass
+}
+
+func newBypassLearner(threshold int, ttl time.Duration) *bypassLearner {
+	if threshold <= 0 {
+		threshold = defaultLearnThreshold
+	}
+	if ttl <= 0 {
+		ttl = defaultLearnTTL
+	}
+	return &bypassLearner{
+		threshold: threshold,
+		ttl:       ttl,
+		failures:  make(map[string]int),
+		learned:   make(map[string]*LearnedBypass),
+	}
+}
+
+func learnKey(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// lookup returns the live learned entry for host, dropping an expired one
+func (l *bypassLearner) lookup(host string) (LearnedBypass, bool) {
+	key := learnKey(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.learned[key]
+	if !ok {
+		return LearnedBypass{}, false
+	}
+	if time.Now().After(b.ExpiresAt) {
+		delete(l.learned, key)
+		log.Printf("[Learn] Learned bypass for %s expired", key)
+		return LearnedBypass{}, false
+	}
+	return *b, true
+}
+
+// failure records a rejected handshake and reports whether host was learned
+func (l *bypassLearner) failure(host, reason string) bool {
+	key := learnKey(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[key]++
+	n := l.failures[key]
+	if n < l.threshold {
+		return false
+	}
+	delete(l.failures, key)
+	now := time.Now()
+	l.learned[key] = &LearnedBypass{
+		Host:      key,
+		Failures:  n,
+		Reason:    reason,
+		LearnedAt: now,
+		ExpiresAt: now.Add(l.ttl),
+	}
+	return true
+}
+
+// success resets the failure count of host after a completed handshake
+func (l *bypassLearner) success(host string) {
+	key := learnKey(host)
+	l.mu.Lock()
+	delete(l.failures, key)
+	l.mu.Unlock()
+}
+
+func (l *bypassLearner) list() []LearnedBypass {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]LearnedBypass, 0, len(l.learned))
+	for key, b := range l.learned {
+		if now.After(b.ExpiresAt) {
+			delete(l.learned, key)
+			continue
+		}
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+	return list
+}
+
+func (l *bypassLearner) restore(list []LearnedBypass) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range list {
+		if b.Host == "" || now.After(b.ExpiresAt) {
+			continue
+		}
+		b := b
+		b.Host = learnKey(b.Host)
+		l.learned[b.Host] = &b
+	}
+}
+
+func (l *bypassLearner) forget(host string) bool {
+	key := learnKey(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+	if _, ok := l.learned[key]; !ok {
+		return false
+	}
+	delete(l.learned, key)
+	return true
+}
+
+// pinningFailure reports whether err from a client handshake that already
+// received our certificate looks like the client rejecting it. Only
+// certificate alerts count: a connection closed mid-handshake may be a
+// closed tab or a lost happy-eyeballs race as well as a pinned app.
+func pinningFailure(err error) (string, bool) {
+	msg := err.Error()
+	for _, alert := range []struct{ text, reason string }{
+		{"bad certificate", "bad_certificate alert"},
+		{"unknown certificate authority", "unknown_ca alert"},
+		{"certificate unknown", "certificate_unknown alert"},
+		{"unsupported certificate", "unsupported_certificate alert"},
+	} {
+		if strings.Contains(msg, "remote error: tls: "+alert.text) {
+			return alert.reason, true
+		}
+	}
+	return "", false
+}
+
+// LearnedBypasses returns the hosts currently bypassed because clients
+// rejected their certificates. It is empty unless Options.LearnBypass is set.
+func (e *Echo) LearnedBypasses() []LearnedBypass {
+	if e.connectHandler.learner == nil {
+		return nil
+	}
+	return e.connectHandler.learner.list()
+}
+
+// RestoreLearnedBypasses adds previously saved entries, skipping expired ones
+func (e *Echo) RestoreLearnedBypasses(list []LearnedBypass) {
+	if e.connectHandler.learner != nil {
+		e.connectHandler.learner.restore(list)
+	}
+}
+
+// ForgetLearnedBypass removes host from the learned list so it is
+// intercepted again. It reports whether host was on the list.
+func (e *Echo) ForgetLearnedBypass(host string) bool {
+	if e.connectHandler.learner == nil {
+		return false
+	}
+	return e.connectHandler.learner.forget(host)
+}
+
+// SaveLearnedBypasses writes the learned list to path as JSON
+func (e *Echo) SaveLearnedBypasses(path string) error {
+	data, err := json.MarshalIndent(e.LearnedBypasses(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// LoadLearnedBypasses restores a list written by SaveLearnedBypasses.
+// A missing file is not an error.
+func (e *Echo) LoadLearnedBypasses(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []LearnedBypass
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	e.RestoreLearnedBypasses(list)
+	return nil
+}
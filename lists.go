@@ -0,0 +1,503 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ListFormat is the file format of a domain list
+type ListFormat string
+
+const (
+	ListAuto    ListFormat = ""        // detect from the content
+	ListPlain   ListFormat = "plain"   // one pattern per line, "#" comments
+	ListClash   ListFormat = "clash"   // Clash rule-provider: "payload:" with DOMAIN-SUFFIX,... or +.domain entries
+	ListGFWList ListFormat = "gfwlist" // base64-encoded AutoProxy rules
+)
+
+// ListAction is what happens to hosts on a list
+type ListAction string
+
+const (
+	ListBypass ListAction = "bypass" // tunnel without MITM (default)
+	ListDirect ListAction = "direct" // reach the target without the upstream proxy
+)
+
+const (
+	listGroupPrefix    = "list:"
+	defaultListRefresh = 24 * time.Hour
+	listFetchTimeout   = 30 * time.Second
+)
+
+// ListSource describes a bypass or direct list loaded with Echo.LoadList
+type ListSource struct {
+	Name   string     `yaml:"name"`   // identifies the list; defaults to Path or URL
+	Path   string     `yaml:"path"`   // local file, reloaded when it changes
+	URL    string     `yaml:"url"`    // remote file, cached on disk and refreshed
+	Format ListFormat `yaml:"format"` // ListAuto if empty
+	Action ListAction `yaml:"action"` // ListBypass if empty
+
+	// Refresh is how often a URL list is fetched again (default 24h)
+	Refresh time.Duration `yaml:"refresh"`
+	// CacheFile keeps the last fetched copy of a URL list. It defaults to a
+	// file under the user cache directory.
+	CacheFile string `yaml:"cache_file"`
+}
+
+func (s *ListSource) name() string {
+	switch {
+	case s.Name != "":
+		return s.Name
+	case s.Path != "":
+		return s.Path
+	default:
+		return s.URL
+	}
+}
+
+func (s *ListSource) validate() error {
+	if (s.Path == "") == (s.URL == "") {
+		return errors.New("exactly one of path and url is required")
+	}
+	switch s.Format {
+	case ListAuto, ListPlain, ListClash, ListGFWList:
+	default:
+		return fmt.Errorf("unknown format %q (supported: plain, clash, gfwlist)", s.Format)
+	}
+	switch s.Action {
+	case "", ListBypass, ListDirect:
+	default:
+		return fmt.Errorf("unknown action %q (supported: bypass, direct)", s.Action)
+	}
+	if s.URL != "" {
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q", s.URL)
+		}
+	}
+	return nil
+}
+
+func (s *ListSource) cacheFile() string {
+	if s.CacheFile != "" {
+		return s.CacheFile
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	sum := sha1.Sum([]byte(s.URL))
+	return filepath.Join(dir, "echo", "lists", hex.EncodeToString(sum[:])+".txt")
+}
+
+// ParseList reads the patterns of a domain list. Entries become Match
+// patterns: DOMAIN-SUFFIX and "||host" entries match the domain and its
+// subdomains, DOMAIN entries match exactly and DOMAIN-KEYWORD entries
+// match as a substring. Entries that cannot be expressed are skipped.
+func ParseList(data []byte, format ListFormat) ([]string, error) {
+	if format == ListAuto {
+		format = detectListFormat(data)
+	}
+	var patterns []string
+	var err error
+	switch format {
+	case ListPlain:
+		patterns = parsePlainList(data)
+	case ListClash:
+		patterns, err = parseClashList(data)
+	case ListGFWList:
+		patterns, err = parseGFWList(data)
+	default:
+		return nil, fmt.Errorf("unknown list format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(patterns))
+	valid := patterns[:0]
+	for _, p := range patterns {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if _, err := CompileMatch(p); err != nil {
+			continue
+		}
+		valid = append(valid, p)
+	}
+	return valid, nil
+}
+
+func detectListFormat(data []byte) ListFormat {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("payload:")) || bytes.Contains(trimmed, []byte("\npayload:")) {
+		return ListClash
+	}
+	if decoded, err := decodeGFWList(trimmed); err == nil &&
+		(bytes.HasPrefix(decoded, []byte("[AutoProxy")) || bytes.Contains(decoded, []byte("\n||"))) {
+		return ListGFWList
+	}
+	return ListPlain
+}
+
+// parsePlainList accepts Match patterns and Clash rule lines, one per line
+func parsePlainList(data []byte) []string {
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if p, ok := clashRule(line); ok {
+			if p != "" {
+				patterns = append(patterns, p)
+			}
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+func parseClashList(data []byte) ([]string, error) {
+	var provider struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.Unmarshal(data, &provider); err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, entry := range provider.Payload {
+		entry = strings.TrimSpace(entry)
+		if p, ok := clashRule(entry); ok {
+			if p != "" {
+				patterns = append(patterns, p)
+			}
+			continue
+		}
+		// domain behavior: "+.example.com", ".example.com", "*.example.com", "example.com"
+		switch {
+		case strings.HasPrefix(entry, "+."):
+			patterns = append(patterns, "domain:"+entry[2:])
+		case strings.HasPrefix(entry, "."):
+			patterns = append(patterns, "*"+entry)
+		case strings.HasPrefix(entry, "*."):
+			patterns = append(patterns, entry)
+		case entry != "":
+			patterns = append(patterns, "exact:"+entry)
+		}
+	}
+	return patterns, nil
+}
+
+// clashRule converts a "TYPE,value[,...]" rule. ok is false when line is
+// not a rule; an unsupported rule type gives "" and ok true.
+func clashRule(line string) (string, bool) {
+	fields := strings.Split(line, ",")
+	if len(fields) < 2 {
+		return "", false
+	}
+	value := strings.TrimSpace(fields[1])
+	switch strings.ToUpper(strings.TrimSpace(fields[0])) {
+	case "DOMAIN-SUFFIX":
+		return "domain:" + value, true
+	case "DOMAIN":
+		return "exact:" + value, true
+	case "DOMAIN-KEYWORD":
+		return "contains:" + value, true
+	case "IP-CIDR", "IP-CIDR6":
+		return "cidr:" + value, true
+	default:
+		return "", true
+	}
+}
+
+func decodeGFWList(data []byte) ([]byte, error) {
+	compact := bytes.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+	return base64.StdEncoding.DecodeString(string(compact))
+}
+
+// parseGFWList keeps the host of each blocking rule. Exceptions ("@@"),
+// regular expressions and keyword rules are skipped.
+func parseGFWList(data []byte) ([]string, error) {
+	decoded, err := decodeGFWList(bytes.TrimSpace(data))
+	if err != nil {
+		return nil, fmt.Errorf("gfwlist: %v", err)
+	}
+	var patterns []string
+	scanner := bufio.NewScanner(bytes.NewReader(decoded))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "/") {
+			continue
+		}
+		var host string
+		switch {
+		case strings.HasPrefix(line, "||"):
+			host = line[2:]
+		case strings.HasPrefix(line, "|"):
+			u, err := url.Parse(line[1:])
+			if err != nil {
+				continue
+			}
+			host = u.Host
+		default:
+			host = strings.TrimPrefix(line, ".")
+		}
+		if i := strings.IndexAny(host, "/^:"); i >= 0 {
+			host = host[:i]
+		}
+		host = strings.TrimPrefix(host, ".")
+		if host == "" || strings.Contains(host, "*") || !strings.Contains(host, ".") {
+			continue
+		}
+		if net.ParseIP(host) != nil {
+			patterns = append(patterns, "exact:"+host)
+		} else {
+			patterns = append(patterns, "domain:"+host)
+		}
+	}
+	return patterns, nil
+}
+
+// listPlugins turns list patterns into plugins that carry the action
+func listPlugins(patterns []string, action ListAction) []*Plugin {
+	plugins := make([]*Plugin, len(patterns))
+	for i, p := range patterns {
+		plugins[i] = &Plugin{Match: p, Bypass: action != ListDirect, Direct: action == ListDirect}
+	}
+	return plugins
+}
+
+// listWatcher keeps one loaded list up to date
+type listWatcher struct {
+	stop chan struct{}
+}
+
+// LoadList loads a bypass or direct list and keeps it up to date: a Path
+// list is reloaded when the file changes, a URL list is fetched again every
+// Refresh and served from its cache file meanwhile or when the fetch fails.
+// Loading a list with the name of a loaded one replaces it.
+func (e *Echo) LoadList(src ListSource) error {
+	if err := src.validate(); err != nil {
+		return fmt.Errorf("list %s: %v", src.name(), err)
+	}
+	if src.Action == "" {
+		src.Action = ListBypass
+	}
+
+	var modTime time.Time
+	var err error
+	if src.Path != "" {
+		modTime, err = e.loadListFile(&src)
+	} else {
+		err = e.loadListURL(&src, false)
+	}
+	if err != nil {
+		return fmt.Errorf("list %s: %v", src.name(), err)
+	}
+
+	w := &listWatcher{stop: make(chan struct{})}
+	e.mu.Lock()
+	if e.lists == nil {
+		e.lists = make(map[string]*listWatcher)
+		// One closer stops every watcher, however often lists are reloaded
+		e.closers = append(e.closers, e.stopListWatchers)
+	}
+	if old := e.lists[src.name()]; old != nil {
+		close(old.stop)
+	}
+	e.lists[src.name()] = w
+	e.mu.Unlock()
+
+	go e.watchList(src, w, modTime)
+	return nil
+}
+
+// stopListWatchers stops all list watchers on Close
+func (e *Echo) stopListWatchers() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, w := range e.lists {
+		close(w.stop)
+	}
+	e.lists = nil
+}
+
+// UpdateList replaces the patterns of the named list at runtime. Patterns
+// use the Match syntax; the list does not need to have been loaded before.
+func (e *Echo) UpdateList(name string, patterns []string, action ListAction) {
+	e.pluginLoader.SetGroup(listGroupPrefix+name, listPlugins(patterns, action))
+}
+
+// RemoveList stops refreshing the named list and drops its patterns
+func (e *Echo) RemoveList(name string) {
+	e.mu.Lock()
+	if w := e.lists[name]; w != nil {
+		close(w.stop)
+		delete(e.lists, name)
+	}
+	e.mu.Unlock()
+	e.pluginLoader.SetGroup(listGroupPrefix+name, nil)
+}
+
+// List returns the patterns of the named list
+func (e *Echo) List(name string) []string {
+	plugins := e.pluginLoader.GetGroup(listGroupPrefix + name)
+	patterns := make([]string, len(plugins))
+	for i, p := range plugins {
+		patterns[i] = p.Match
+	}
+	return patterns
+}
+
+func (e *Echo) applyList(src *ListSource, data []byte) error {
+	patterns, err := ParseList(data, src.Format)
+	if err != nil {
+		return err
+	}
+	e.UpdateList(src.name(), patterns, src.Action)
+	log.Printf("[List] Loaded %d %s pattern(s) from %s", len(patterns), src.Action, src.name())
+	return nil
+}
+
+func (e *Echo) loadListFile(src *ListSource) (time.Time, error) {
+	info, err := os.Stat(src.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	data, err := os.ReadFile(src.Path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), e.applyList(src, data)
+}
+
+// loadListURL applies the cached copy when it is fresh (or when force is
+// false and the fetch fails) and fetches the list otherwise
+func (e *Echo) loadListURL(src *ListSource, force bool) error {
+	refresh := src.Refresh
+	if refresh <= 0 {
+		refresh = defaultListRefresh
+	}
+	cache := src.cacheFile()
+	cached, cacheErr := os.ReadFile(cache)
+	var cachedAt time.Time
+	if info, err := os.Stat(cache); err == nil {
+		cachedAt = info.ModTime()
+	}
+	if cacheErr == nil && !force && time.Since(cachedAt) < refresh {
+		return e.applyList(src, cached)
+	}
+
+	data, err := fetchList(src.URL, cachedAt)
+	switch {
+	case err == nil && data == nil:
+		// not modified
+		now := time.Now()
+		os.Chtimes(cache, now, now)
+		return e.applyList(src, cached)
+	case err == nil:
+		if err := os.MkdirAll(filepath.Dir(cache), 0o755); err == nil {
+			os.WriteFile(cache, data, 0o644)
+		}
+		return e.applyList(src, data)
+	case cacheErr == nil:
+		log.Printf("[List] Fetching %s failed, using cached copy: %v", src.URL, err)
+		return e.applyList(src, cached)
+	default:
+		return err
+	}
+}
+
+// fetchList downloads url; it returns nil data when the server reports the
+// copy from since as current
+func fetchList(url string, since time.Time) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	client := &http.Client{Timeout: listFetchTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(res.Body)
+	case http.StatusNotModified:
+		if since.IsZero() {
+			return nil, errors.New("unexpected 304 Not Modified")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+}
+
+// watchList polls a Path list for changes or refreshes a URL list until the
+// list is replaced, removed or Echo is closed
+func (e *Echo) watchList(src ListSource, w *listWatcher, modTime time.Time) {
+	interval := configPollInterval
+	if src.URL != "" {
+		interval = src.Refresh
+		if interval <= 0 {
+			interval = defaultListRefresh
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		if src.URL != "" {
+			if err := e.loadListURL(&src, true); err != nil {
+				log.Printf("[List] Refreshing %s failed, keeping the previous list: %v", src.name(), err)
+			}
+			continue
+		}
+		info, err := os.Stat(src.Path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		if _, err := e.loadListFile(&src); err != nil {
+			log.Printf("[List] Reloading %s failed, keeping the previous list: %v", src.name(), err)
+		}
+	}
+}
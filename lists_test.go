@@ -0,0 +1,166 @@
+package echo_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestParseList(t *testing.T) {
+	gfwlist := base64.StdEncoding.EncodeToString([]byte(
+		"[AutoProxy 0.2.9]\n! comment\n||blocked.com\n|https://www.direct.org/path\n.dot.net\n@@||allowed.com\n/^https?:\\/\\/regex\\./\n"))
+
+	cases := []struct {
+		name     string
+		format   echo.ListFormat
+		data     string
+		expected []string
+	}{
+		{
+			"plain", echo.ListAuto,
+			"# comment\nexample.com\n*.cdn.example.net # trailing\nDOMAIN-SUFFIX,apple.com\n\nexample.com\n",
+			[]string{"example.com", "*.cdn.example.net", "domain:apple.com"},
+		},
+		{
+			"clash classical", echo.ListAuto,
+			"payload:\n  - DOMAIN-SUFFIX,google.com\n  - DOMAIN,www.apple.com\n  - DOMAIN-KEYWORD,tracker\n  - IP-CIDR,10.0.0.0/8,no-resolve\n  - PROCESS-NAME,curl\n",
+			[]string{"domain:google.com", "exact:www.apple.com", "contains:tracker", "cidr:10.0.0.0/8"},
+		},
+		{
+			"clash domain", echo.ListClash,
+			"payload:\n  - '+.example.com'\n  - '.sub.example.org'\n  - 'exact.example.net'\n",
+			[]string{"domain:example.com", "*.sub.example.org", "exact:exact.example.net"},
+		},
+		{
+			"gfwlist", echo.ListAuto, gfwlist,
+			[]string{"domain:blocked.com", "domain:www.direct.org", "domain:dot.net"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := echo.ParseList([]byte(c.data), c.format)
+			if err != nil {
+				t.Fatalf("ParseList: %v", err)
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+// waitFor polls cond for up to two seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func connectAction(t *testing.T, e *echo.Echo, rawURL string) echo.ConnectAction {
+	t.Helper()
+	ex, err := e.Explain("GET", rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ex.Connect.Action
+}
+
+func TestLoadListFromFile(t *testing.T) {
+	e := newTestEcho(t, nil)
+	path := filepath.Join(t.TempDir(), "bypass.txt")
+	if err := os.WriteFile(path, []byte("pinned.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.LoadList(echo.ListSource{Name: "pinned", Path: path}); err != nil {
+		t.Fatalf("LoadList: %v", err)
+	}
+	if connectAction(t, e, "https://api.pinned.example.com/") != echo.ConnectTunnel {
+		t.Fatalf("expected the listed host to be bypassed")
+	}
+
+	// The file is watched for changes
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("other.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	waitFor(t, "the list to reload", func() bool {
+		return connectAction(t, e, "https://api.pinned.example.com/") == echo.ConnectMITM &&
+			connectAction(t, e, "https://other.example.com/") == echo.ConnectTunnel
+	})
+
+	e.RemoveList("pinned")
+	if connectAction(t, e, "https://other.example.com/") != echo.ConnectMITM {
+		t.Fatalf("expected the removed list to stop applying")
+	}
+}
+
+func TestLoadListFromURL(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte("payload:\n  - DOMAIN-SUFFIX,remote.example.com\n"))
+	}))
+	defer server.Close()
+
+	cache := filepath.Join(t.TempDir(), "list.yaml")
+	src := echo.ListSource{Name: "remote", URL: server.URL, CacheFile: cache, Refresh: time.Hour}
+
+	e := newTestEcho(t, nil)
+	if err := e.LoadList(src); err != nil {
+		t.Fatalf("LoadList: %v", err)
+	}
+	if got := e.List("remote"); !reflect.DeepEqual(got, []string{"domain:remote.example.com"}) {
+		t.Fatalf("unexpected patterns %q", got)
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Fatalf("expected a cache file: %v", err)
+	}
+
+	// A fresh cache is used without fetching, even when the server is gone
+	server.Close()
+	other := newTestEcho(t, nil)
+	if err := other.LoadList(src); err != nil {
+		t.Fatalf("LoadList from cache: %v", err)
+	}
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Fatalf("expected 1 fetch, got %d", fetches)
+	}
+	if connectAction(t, other, "https://remote.example.com/") != echo.ConnectTunnel {
+		t.Fatalf("expected the cached list to apply")
+	}
+}
+
+func TestDirectList(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{UpstreamProxy: "http://127.0.0.1:7890", InterceptOnlyMatched: true})
+	e.UpdateList("direct", []string{"intranet.example.com"}, echo.ListDirect)
+
+	ex, err := e.Explain("GET", "https://intranet.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Connect.Action != echo.ConnectTunnel || ex.Upstream != "direct" {
+		t.Fatalf("expected a direct tunnel, got %s via %s", ex.Connect.Action, ex.Upstream)
+	}
+	ex, err = e.Explain("GET", "http://intranet.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Upstream != "direct" {
+		t.Fatalf("expected plain HTTP to skip the upstream proxy, got %s", ex.Upstream)
+	}
+}
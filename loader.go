@@ -1,190 +1,454 @@
 package echo
 
 import (
+	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 )
 
-// PluginLoader handles loading and managing plugins
+// PluginLoader handles loading and managing plugins.
+//
+// Plugins are kept in named groups so that one source (the config file, a
+// bypass list, ...) can be swapped as a whole without touching the others.
+// The default group "" holds plugins passed to Load and AddPlugin.
+// Match patterns and conditions are compiled when a plugin is added.
 type PluginLoader struct {
-	plugins []*Plugin
+	mu     sync.RWMutex
+	groups []*pluginGroup
+	set    *pluginSet // snapshot of all groups, in group order
+}
+
+type pluginGroup struct {
+	name     string
+	plugins  []*Plugin
+	compiled []*compiledPlugin // plugins whose pattern compiled
+}
+
+// pluginSet is an immutable snapshot that readers use without locking
+type pluginSet struct {
+	plugins  []*Plugin
+	compiled []*compiledPlugin
+
+	indexOnce sync.Once
+	index     *hostIndex // built on first lookup
+}
+
+// candidates returns, in order, the plugins whose host pattern may match
+func (s *pluginSet) candidates(hostname string) []*compiledPlugin {
+	s.indexOnce.Do(func() {
+		s.index = newHostIndex(s.compiled)
+	})
+	positions := s.index.lookup(hostname)
+	candidates := make([]*compiledPlugin, len(positions))
+	for i, pos := range positions {
+		candidates[i] = s.compiled[pos]
+	}
+	return candidates
+}
+
+// compiledPlugin is a plugin with its match pattern and conditions compiled
+type compiledPlugin struct {
+	plugin   *Plugin
+	matcher  *Matcher
+	methods  []string
+	query    map[string]*valueMatcher
+	headers  map[string]*valueMatcher
+	clients  []*net.IPNet
+	response *responseMatcher
+	tls      *upstreamTLS
+	balancer *balancer // set when the plugin has Targets
+	mirror   *mirror
+	local    *mapLocal
 }
 
 // NewPluginLoader creates a new plugin loader
 func NewPluginLoader(plugins []*Plugin) (*PluginLoader, error) {
-	loader := &PluginLoader{}
+	loader := &PluginLoader{set: &pluginSet{}}
 	if err := loader.Load(plugins); err != nil {
 		return nil, err
 	}
 	return loader, nil
 }
 
-// Load loads plugins from the hardcoded registry
+// Load replaces the plugins of the default group.
+// It fails without changing anything if a plugin does not compile.
 func (l *PluginLoader) Load(plugins []*Plugin) error {
-
-	l.plugins = plugins
-	// fmt.Printf("Loaded %d plugin(s) from hardcoded registry\n", len(l.plugins))
+	for i, p := range plugins {
+		if _, err := compilePlugin(p); err != nil {
+			return fmt.Errorf("plugin %d: %w", i, err)
+		}
+	}
+	l.SetGroup("", plugins)
 	return nil
 }
 
+// AddPlugin appends a plugin to the default group.
+// A plugin that does not compile is logged and never matches.
 func (l *PluginLoader) AddPlugin(plugin *Plugin) {
-	l.plugins = append(l.plugins, plugin)
+	cp, err := compilePlugin(plugin)
+	if err != nil {
+		log.Printf("[Plugin] Ignoring plugin %q: %v", plugin.Match, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	g := l.group("")
+	g.plugins = append(g.plugins, plugin)
+	if cp != nil {
+		g.compiled = append(g.compiled, cp)
+	}
+	l.rebuild()
+}
+
+// SetGroup atomically replaces all plugins of the named group.
+// A new group is appended after the existing ones; an empty list removes it.
+// Plugins that do not compile are logged and never match.
+func (l *PluginLoader) SetGroup(name string, plugins []*Plugin) {
+	l.setGroups([]string{name}, [][]*Plugin{plugins})
+}
+
+// setGroups replaces several groups in one atomic step
+func (l *PluginLoader) setGroups(names []string, plugins [][]*Plugin) {
+	compiled := make([][]*compiledPlugin, len(plugins))
+	for i := range plugins {
+		compiled[i] = compilePlugins(plugins[i])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, name := range names {
+		if len(plugins[i]) == 0 && name != "" {
+			l.removeGroup(name)
+		} else {
+			g := l.group(name)
+			g.plugins = append([]*Plugin(nil), plugins[i]...)
+			g.compiled = compiled[i]
+		}
+	}
+	l.rebuild()
+}
+
+func compilePlugins(plugins []*Plugin) []*compiledPlugin {
+	compiled := make([]*compiledPlugin, 0, len(plugins))
+	for _, p := range plugins {
+		cp, err := compilePlugin(p)
+		if err != nil {
+			log.Printf("[Plugin] Ignoring plugin %q: %v", p.Match, err)
+			continue
+		}
+		compiled = append(compiled, cp)
+	}
+	return compiled
+}
+
+// GetGroup returns the plugins of the named group
+func (l *PluginLoader) GetGroup(name string) []*Plugin {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, g := range l.groups {
+		if g.name == name {
+			return g.plugins
+		}
+	}
+	return nil
+}
+
+// group returns the named group, creating it if needed. Caller holds l.mu.
+func (l *PluginLoader) group(name string) *pluginGroup {
+	for _, g := range l.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	g := &pluginGroup{name: name}
+	l.groups = append(l.groups, g)
+	return g
+}
+
+// removeGroup deletes the named group. Caller holds l.mu.
+func (l *PluginLoader) removeGroup(name string) {
+	for i, g := range l.groups {
+		if g.name == name {
+			l.groups = append(l.groups[:i:i], l.groups[i+1:]...)
+			return
+		}
+	}
+}
+
+// rebuild refreshes the snapshot. Caller holds l.mu.
+func (l *PluginLoader) rebuild() {
+	set := &pluginSet{}
+	for _, g := range l.groups {
+		set.plugins = append(set.plugins, g.plugins...)
+		set.compiled = append(set.compiled, g.compiled...)
+	}
+	l.set = set
+}
+
+// snapshot returns the current plugin set; it is never mutated in place
+func (l *PluginLoader) snapshot() *pluginSet {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.set
 }
 
 // GetPlugins returns all loaded plugins
 func (l *PluginLoader) GetPlugins() []*Plugin {
-	return l.plugins
+	return l.snapshot().plugins
 }
 
 // MatchPlugin finds the first plugin that matches the given hostname
 func (l *PluginLoader) MatchPlugin(hostname string) *Plugin {
-	for i := range l.plugins {
-		if matchHostname(hostname, l.plugins[i].Match) {
-			return l.plugins[i]
-		}
+	if matches := l.MatchConnect(hostname, "", ""); len(matches) > 0 {
+		return matches[0]
 	}
 	return nil
 }
 
 // MatchPlugins returns all plugins that match the given hostname, in order
 func (l *PluginLoader) MatchPlugins(hostname string) []*Plugin {
+	return l.MatchConnect(hostname, "", "")
+}
+
+// MatchConnect returns all plugins, in order, whose host pattern matches a
+// CONNECT target. An empty port matches any; an empty clientAddr matches
+// only plugins without ClientAddr. Request conditions
+// (method, query, headers) are unknown at this stage and do not exclude a
+// plugin.
+func (l *PluginLoader) MatchConnect(hostname, port, clientAddr string) []*Plugin {
+	client := clientIP(clientAddr)
 	var matches []*Plugin
-	for i := range l.plugins {
-		if matchHostname(hostname, l.plugins[i].Match) {
-			matches = append(matches, l.plugins[i])
+	for _, cp := range l.snapshot().candidates(hostname) {
+		if cp.matchConnect(hostname, port, client) {
+			matches = append(matches, cp.plugin)
 		}
 	}
 	return matches
 }
 
-// matchHostname checks if hostname matches the pattern.
-// It extracts the hostname part from patterns that contain scheme or path.
-func matchHostname(hostname, pattern string) bool {
-	// Extract hostname from pattern if it contains scheme or path
-	patternHost := extractHostFromPattern(pattern)
-	return IsMatch(hostname, patternHost)
-}
-
-// extractHostFromPattern extracts the hostname/host pattern from a full URL pattern
-func extractHostFromPattern(pattern string) string {
-	// Remove scheme if present
-	p := pattern
-	if strings.HasPrefix(p, "https://") {
-		p = p[8:]
-	} else if strings.HasPrefix(p, "http://") {
-		p = p[7:]
-	} else if strings.HasPrefix(p, "wss://") {
-		p = p[6:]
-	} else if strings.HasPrefix(p, "ws://") {
-		p = p[5:]
-	}
-
-	// Remove path if present (find first /)
-	if idx := strings.Index(p, "/"); idx != -1 {
-		p = p[:idx]
-	}
-
-	// Remove port if present (but preserve wildcards like *.example.com)
-	// Only remove port if it looks like host:port
-	if idx := strings.LastIndex(p, ":"); idx != -1 {
-		// Check if everything after : is digits (port number)
-		port := p[idx+1:]
-		isPort := true
-		for _, c := range port {
-			if c < '0' || c > '9' {
-				isPort = false
-				break
-			}
-		}
-		if isPort && len(port) > 0 {
-			p = p[:idx]
+// direct reports whether a plugin with Direct set matches the host for
+// the client
+func (l *PluginLoader) direct(hostname, port, clientAddr string) bool {
+	for _, p := range l.MatchConnect(hostname, port, clientAddr) {
+		if p.Direct {
+			return true
 		}
 	}
+	return false
+}
 
-	return p
+// target returns the target of cp for r, choosing among Targets when
+// there are several, and the balancer to report the outcome to
+func (cp *compiledPlugin) target(r *http.Request) (*TargetConfig, *balancer) {
+	if cp.balancer != nil {
+		return cp.balancer.pick(r), cp.balancer
+	}
+	return cp.plugin.Target, nil
 }
 
+// upstreamTLS returns the TLS settings of the last plugin matching a
+// CONNECT target that has any, or nil
+func (l *PluginLoader) upstreamTLS(hostname, port, clientAddr string) *upstreamTLS {
+	client := clientIP(clientAddr)
+	var selected *upstreamTLS
+	for _, cp := range l.snapshot().candidates(hostname) {
+		if cp.tls != nil && cp.matchConnect(hostname, port, client) {
+			selected = cp.tls
+		}
+	}
+	return selected
+}
+
+// MatchPluginForRequest returns the first plugin that matches the request
 func (l *PluginLoader) MatchPluginForRequest(r *http.Request) *Plugin {
+	if matches := l.MatchPluginsForRequest(r); len(matches) > 0 {
+		return matches[0]
+	}
+	return nil
+}
+
+// MatchPluginsForRequest returns all plugins that match the given request URL/host, in order
+func (l *PluginLoader) MatchPluginsForRequest(r *http.Request) []*Plugin {
+	matched := l.matchRequest(r)
+	if len(matched) == 0 {
+		return nil
+	}
+	matches := make([]*Plugin, len(matched))
+	for i, cp := range matched {
+		matches[i] = cp.plugin
+	}
+	return matches
+}
+
+// matchRequest is MatchPluginsForRequest returning the compiled plugins
+func (l *PluginLoader) matchRequest(r *http.Request) []*compiledPlugin {
 	if r == nil {
 		return nil
 	}
-	scheme := r.URL.Scheme
-	if scheme == "" {
-		scheme = "http"
+	u := requestURL(r)
+	client := clientIP(r.RemoteAddr)
+
+	var matches []*compiledPlugin
+	for _, cp := range l.snapshot().candidates(u.Hostname()) {
+		if cp.matchRequest(r, u, client) {
+			matches = append(matches, cp)
+		}
+	}
+	return matches
+}
+
+// requestURL returns the absolute URL of a proxied request
+func requestURL(r *http.Request) *url.URL {
+	u := *r.URL
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	if u.Host == "" {
+		u.Host = r.Host
 	}
-	host := r.URL.Host
-	if host == "" {
-		host = r.Host
+	return &u
+}
+
+// clientIP extracts the IP from a "host:port" or bare address
+func clientIP(addr string) net.IP {
+	if addr == "" {
+		return nil
 	}
-	fullURL := scheme + "://" + host + r.URL.Path
-	if r.URL.RawQuery != "" {
-		fullURL += "?" + r.URL.RawQuery
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
+	return net.ParseIP(addr)
+}
 
-	hostname := r.URL.Hostname()
-	if hostname == "" {
-		hostname = r.Host
-		if h, _, err := net.SplitHostPort(hostname); err == nil {
-			hostname = h
+// compilePlugin compiles the match pattern and request conditions of p
+func compilePlugin(p *Plugin) (*compiledPlugin, error) {
+	m, err := CompileMatch(p.Match)
+	if err != nil {
+		return nil, err
+	}
+	cp := &compiledPlugin{plugin: p, matcher: m}
+	for _, method := range p.Methods {
+		cp.methods = append(cp.methods, strings.ToUpper(method))
+	}
+	if len(p.Query) > 0 {
+		cp.query = make(map[string]*valueMatcher, len(p.Query))
+		for k, v := range p.Query {
+			vm, err := compileValueMatcher(v)
+			if err != nil {
+				return nil, fmt.Errorf("query %q: %w", k, err)
+			}
+			cp.query[k] = vm
 		}
 	}
-
-	for i := range l.plugins {
-		pattern := l.plugins[i].Match
-		if containsScheme(pattern) || strings.Contains(pattern, "/") {
-			if IsMatch(fullURL, pattern) {
-				return l.plugins[i]
+	if len(p.Headers) > 0 {
+		cp.headers = make(map[string]*valueMatcher, len(p.Headers))
+		for k, v := range p.Headers {
+			vm, err := compileValueMatcher(v)
+			if err != nil {
+				return nil, fmt.Errorf("header %q: %w", k, err)
 			}
-		} else if IsMatch(hostname, pattern) {
-			return l.plugins[i]
+			cp.headers[http.CanonicalHeaderKey(k)] = vm
 		}
 	}
-	return nil
+	for _, addr := range p.ClientAddr {
+		ipnet, err := parseIPNet(addr)
+		if err != nil {
+			return nil, fmt.Errorf("client address: %w", err)
+		}
+		cp.clients = append(cp.clients, ipnet)
+	}
+	if cp.response, err = compileResponseMatch(p.Response); err != nil {
+		return nil, err
+	}
+	if cp.tls, err = compileUpstreamTLS(p.UpstreamTLS); err != nil {
+		return nil, fmt.Errorf("upstream TLS: %w", err)
+	}
+	if cp.mirror, err = compileMirror(p.Mirror); err != nil {
+		return nil, err
+	}
+	if cp.local, err = compileMapLocal(p.MapLocal, m.path); err != nil {
+		return nil, fmt.Errorf("map local: %w", err)
+	}
+	if len(p.Targets) > 0 {
+		if p.Target != nil {
+			return nil, fmt.Errorf("target and targets are mutually exclusive")
+		}
+		if cp.balancer, err = compileBalancer(p.Targets, p.Balance); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
 }
 
-// MatchPluginsForRequest returns all plugins that match the given request URL/host, in order
-func (l *PluginLoader) MatchPluginsForRequest(r *http.Request) []*Plugin {
-	if r == nil {
-		return nil
-	}
-	scheme := r.URL.Scheme
-	if scheme == "" {
-		scheme = "http"
+// parseIPNet parses a CIDR or a single IP
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
 	}
-	host := r.URL.Host
-	if host == "" {
-		host = r.Host
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
 	}
-	fullURL := scheme + "://" + host + r.URL.Path
-	if r.URL.RawQuery != "" {
-		fullURL += "?" + r.URL.RawQuery
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
 	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (cp *compiledPlugin) matchConnect(hostname, port string, client net.IP) bool {
+	return cp.matchClient(client) && cp.matcher.MatchHost(hostname, port)
+}
 
-	hostname := r.URL.Hostname()
-	if hostname == "" {
-		hostname = r.Host
-		if h, _, err := net.SplitHostPort(hostname); err == nil {
-			hostname = h
+func (cp *compiledPlugin) matchRequest(r *http.Request, u *url.URL, client net.IP) bool {
+	if !cp.matchClient(client) || !cp.matcher.MatchURL(u) {
+		return false
+	}
+	if len(cp.methods) > 0 {
+		found := false
+		for _, m := range cp.methods {
+			if m == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
 		}
 	}
-
-	var matches []*Plugin
-	for i := range l.plugins {
-		pattern := l.plugins[i].Match
-		if containsScheme(pattern) || strings.Contains(pattern, "/") {
-			if IsMatch(fullURL, pattern) {
-				matches = append(matches, l.plugins[i])
+	if len(cp.query) > 0 {
+		query := u.Query()
+		for k, vm := range cp.query {
+			if !vm.match(query[k]) {
+				return false
 			}
-		} else if IsMatch(hostname, pattern) {
-			matches = append(matches, l.plugins[i])
 		}
 	}
-	return matches
+	for k, vm := range cp.headers {
+		if !vm.match(r.Header.Values(k)) {
+			return false
+		}
+	}
+	return true
 }
-func containsScheme(s string) bool {
-	return strings.HasPrefix(s, "http://") ||
-		strings.HasPrefix(s, "https://") ||
-		strings.HasPrefix(s, "ws://") ||
-		strings.HasPrefix(s, "wss://")
+
+// matchClient checks the client address condition; an unknown client
+// matches only plugins without one
+func (cp *compiledPlugin) matchClient(client net.IP) bool {
+	if len(cp.clients) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	for _, ipnet := range cp.clients {
+		if ipnet.Contains(client) {
+			return true
+		}
+	}
+	return false
 }
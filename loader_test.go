@@ -0,0 +1,158 @@
+package echo_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestMatchPluginsForRequestConditions(t *testing.T) {
+	post := &echo.Plugin{Match: "api.example.com", Methods: []string{"post"}}
+	query := &echo.Plugin{Match: "api.example.com/search", Query: map[string]string{"q": "echo*"}}
+	header := &echo.Plugin{Match: "api.example.com", Headers: map[string]string{"X-Debug": ""}}
+	client := &echo.Plugin{Match: "api.example.com", ClientAddr: []string{"10.0.0.0/8"}}
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{post, query, header, client})
+	if err != nil {
+		t.Fatalf("NewPluginLoader: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		method   string
+		url      string
+		header   string
+		remote   string
+		expected []*echo.Plugin
+	}{
+		{"plain get", "GET", "http://api.example.com/", "", "192.168.0.2:1234", nil},
+		{"method", "POST", "http://api.example.com/", "", "192.168.0.2:1234", []*echo.Plugin{post}},
+		{"query glob", "GET", "http://api.example.com/search?q=echo+proxy", "", "192.168.0.2:1234", []*echo.Plugin{query}},
+		{"query mismatch", "GET", "http://api.example.com/search?q=other", "", "192.168.0.2:1234", nil},
+		{"header presence", "GET", "http://api.example.com/", "X-Debug", "192.168.0.2:1234", []*echo.Plugin{header}},
+		{"client cidr", "GET", "http://api.example.com/", "", "10.1.2.3:1234", []*echo.Plugin{client}},
+		{"unknown client", "GET", "http://api.example.com/", "", "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.url, nil)
+			r.RemoteAddr = c.remote
+			if c.header != "" {
+				r.Header.Set(c.header, "1")
+			}
+			got := loader.MatchPluginsForRequest(r)
+			if len(got) != len(c.expected) {
+				t.Fatalf("expected %d plugin(s), got %d", len(c.expected), len(got))
+			}
+			for i := range got {
+				if got[i] != c.expected[i] {
+					t.Fatalf("plugin %d: expected %q, got %q", i, c.expected[i].Match, got[i].Match)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidPattern(t *testing.T) {
+	_, err := echo.NewPluginLoader([]*echo.Plugin{{Match: "/a(/"}})
+	if err == nil {
+		t.Fatalf("expected error for invalid regex")
+	}
+}
+
+func TestLoadRejectsInvalidStatusRange(t *testing.T) {
+	for _, status := range []string{"200-299x", "2oo", "300-200", "200-", "6xx"} {
+		_, err := echo.NewPluginLoader([]*echo.Plugin{{Match: "*", Response: &echo.ResponseMatch{Status: status}}})
+		if err == nil {
+			t.Fatalf("%q: expected an error", status)
+		}
+	}
+	if _, err := echo.NewPluginLoader([]*echo.Plugin{{Match: "*", Response: &echo.ResponseMatch{Status: "2xx, 304, 400-404"}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchConnectIndexOrder(t *testing.T) {
+	patterns := []string{
+		"example.com", "*.example.com", "exact:api.example.com", "/^api\\./",
+		"contains:ample", "*", "api.example.com:8443", "10.0.0.0/8",
+		"other.com", "*.api.example.com", "api-*.example.com", ".example.com",
+	}
+	plugins := make([]*echo.Plugin, len(patterns))
+	for i, p := range patterns {
+		plugins[i] = &echo.Plugin{Match: p}
+	}
+	loader, err := echo.NewPluginLoader(plugins)
+	if err != nil {
+		t.Fatalf("NewPluginLoader: %v", err)
+	}
+
+	hosts := []string{"example.com", "api.example.com", "a.api.example.com", "api-v2.example.com", "API.Example.com.", "other.com", "10.1.2.3", "nomatch.net"}
+	for _, host := range hosts {
+		for _, port := range []string{"", "443", "8443"} {
+			var want []*echo.Plugin
+			for _, p := range plugins {
+				m, _ := echo.CompileMatch(p.Match)
+				if m.MatchHost(host, port) {
+					want = append(want, p)
+				}
+			}
+			got := loader.MatchConnect(host, port, "")
+			if len(got) != len(want) {
+				t.Fatalf("%s:%s: expected %d match(es), got %d", host, port, len(want), len(got))
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("%s:%s: match %d: expected %q, got %q", host, port, i, want[i].Match, got[i].Match)
+				}
+			}
+		}
+	}
+}
+
+// bypassLoader builds a loader with n "*.domainN.com" bypass rules, like an
+// imported domain list
+func bypassLoader(b *testing.B, n int) *echo.PluginLoader {
+	plugins := make([]*echo.Plugin, n)
+	for i := range plugins {
+		plugins[i] = &echo.Plugin{Match: fmt.Sprintf("*.domain%d.com", i), Bypass: true}
+	}
+	loader, err := echo.NewPluginLoader(plugins)
+	if err != nil {
+		b.Fatal(err)
+	}
+	loader.MatchConnect("warm.up", "443", "")
+	return loader
+}
+
+func BenchmarkMatchConnect(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000, 100000} {
+		loader := bypassLoader(b, n)
+		b.Run(fmt.Sprintf("rules=%d/miss", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loader.MatchConnect("www.example.org", "443", "")
+			}
+		})
+		b.Run(fmt.Sprintf("rules=%d/hit", n), func(b *testing.B) {
+			host := fmt.Sprintf("api.domain%d.com", n/2)
+			for i := 0; i < b.N; i++ {
+				if len(loader.MatchConnect(host, "443", "")) != 1 {
+					b.Fatal("expected a match")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMatchPluginsForRequest(b *testing.B) {
+	for _, n := range []int{100, 10000} {
+		loader := bypassLoader(b, n)
+		r := httptest.NewRequest("GET", "https://www.example.org/index.html", nil)
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loader.MatchPluginsForRequest(r)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package echo
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MapLocal answers requests from local files instead of forwarding them,
+// like Charles's Map Local. The request path less Prefix is looked up under
+// Path, or Path itself answers when it is a file. Files are read on every
+// request, so changes show up without a restart. Content types come from
+// the file extension or content, and If-Modified-Since, If-None-Match and
+// Range requests are honoured.
+//
+// Requests outside Prefix are not answered and go on to the target.
+type MapLocal struct {
+	Path     string            `yaml:"path"`     // file or directory
+	Prefix   string            `yaml:"prefix"`   // URL path mapped onto Path; the path of Match by default, else "/"
+	Index    []string          `yaml:"index"`    // files tried for a directory, index.html by default
+	Fallback string            `yaml:"fallback"` // file under Path served when nothing else is, e.g. "index.html" for client-side routing
+	Headers  map[string]string `yaml:"headers"`  // set on the files served; Cache-Control is no-cache unless set here
+}
+
+// mapLocal is a compiled MapLocal
+type mapLocal struct {
+	root     string
+	prefix   string // without the trailing slash
+	index    []string
+	fallback string
+	headers  map[string]string
+}
+
+// compileMapLocal compiles m; matchPath is the path of the plugin's Match
+// pattern, the default prefix when it is a plain prefix
+func compileMapLocal(m *MapLocal, matchPath string) (*mapLocal, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.Path == "" {
+		return nil, errors.New("path is required")
+	}
+	prefix := m.Prefix
+	if prefix == "" && !strings.ContainsAny(matchPath, "*?") {
+		prefix = matchPath
+	}
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("prefix %q must start with /", prefix)
+	}
+	c := &mapLocal{
+		root:     filepath.Clean(m.Path),
+		prefix:   strings.TrimSuffix(prefix, "/"),
+		index:    m.Index,
+		fallback: m.Fallback,
+		headers:  map[string]string{"Cache-Control": "no-cache"},
+	}
+	if len(c.index) == 0 {
+		c.index = []string{"index.html"}
+	}
+	for k, v := range m.Headers {
+		c.headers[http.CanonicalHeaderKey(k)] = v
+	}
+	return c, nil
+}
+
+// lookup maps urlPath to a file. ok is false when urlPath is outside the
+// prefix, and name is "" when no file matches. redirect is set for a
+// directory asked for without its trailing slash.
+func (m *mapLocal) lookup(urlPath string) (name string, redirect, ok bool) {
+	if urlPath == "" {
+		urlPath = "/"
+	}
+	rest := urlPath
+	if m.prefix != "" {
+		// Only whole segments: /static maps /static/app.js but not /statics
+		if !strings.HasPrefix(urlPath, m.prefix) {
+			return "", false, false
+		}
+		if rest = urlPath[len(m.prefix):]; rest != "" && rest[0] != '/' {
+			return "", false, false
+		}
+	}
+	if info, err := os.Stat(m.root); err == nil && !info.IsDir() {
+		return m.root, false, true
+	}
+
+	// Cleaning a rooted path drops any "..", so nothing outside root is served
+	name = filepath.Join(m.root, filepath.FromSlash(path.Clean("/"+rest)))
+	if info, err := os.Stat(name); err == nil {
+		if !info.IsDir() {
+			return name, false, true
+		}
+		if !strings.HasSuffix(urlPath, "/") {
+			return name, true, true
+		}
+		for _, index := range m.index {
+			if f := filepath.Join(name, index); isFile(f) {
+				return f, false, true
+			}
+		}
+	}
+	if m.fallback != "" {
+		if f := filepath.Join(m.root, filepath.FromSlash(path.Clean("/"+m.fallback))); isFile(f) {
+			return f, false, true
+		}
+	}
+	return "", false, true
+}
+
+// serve answers r from the local files and reports whether it did; it
+// does not for requests outside the prefix
+func (m *mapLocal) serve(w http.ResponseWriter, r *http.Request) bool {
+	name, redirect, ok := m.lookup(r.URL.Path)
+	if !ok {
+		return false
+	}
+	if redirect {
+		// Relative links in the index file resolve against the directory
+		location := r.URL.Path + "/"
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return true
+	}
+	if name == "" {
+		log.Printf("[MapLocal] No file for %s under %s", r.URL.Path, m.root)
+		http.NotFound(w, r)
+		return true
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		log.Printf("[MapLocal] %v", err)
+		http.Error(w, "cannot open "+filepath.Base(name), http.StatusInternalServerError)
+		return true
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("[MapLocal] %v", err)
+		http.Error(w, "cannot open "+filepath.Base(name), http.StatusInternalServerError)
+		return true
+	}
+
+	log.Printf("[MapLocal] %s %s -> %s", r.Method, r.URL.Path, name)
+	for k, v := range m.headers {
+		w.Header().Set(k, v)
+	}
+	if w.Header().Get("Etag") == "" {
+		// Changes with every write, so edits are never answered with 304
+		w.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
+
+// isFile reports whether name exists and is not a directory
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
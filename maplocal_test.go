@@ -0,0 +1,131 @@
+package echo_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestMapLocal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site")
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("index.html", "<html>home</html>")
+	write("js/app.js", "console.log(1)")
+	write("docs/index.html", "<html>docs</html>")
+	write("media/clip.bin", "0123456789")
+	write("../secret.txt", "secret")
+
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{{
+		Match:    "app.example.com",
+		Target:   namedTarget("remote", http.StatusOK),
+		MapLocal: &echo.MapLocal{Path: dir, Prefix: "/static/", Headers: map[string]string{"X-Local": "1"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := echo.NewHTTPHandler(loader)
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://app.example.com"+path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.HandleRequest(w, r)
+		return w
+	}
+
+	cases := []struct {
+		path        string
+		status      int
+		body        string
+		contentType string
+	}{
+		{"/static/js/app.js", http.StatusOK, "console.log(1)", "text/javascript; charset=utf-8"},
+		{"/static/", http.StatusOK, "<html>home</html>", "text/html; charset=utf-8"},
+		{"/static/docs/", http.StatusOK, "<html>docs</html>", "text/html; charset=utf-8"},
+		{"/static/docs", http.StatusMovedPermanently, "", ""},
+		{"/static/missing.css", http.StatusNotFound, "", ""},
+		{"/static/../secret.txt", http.StatusNotFound, "", ""},
+		{"/staticx/app.js", http.StatusOK, "remote", ""},
+	}
+	for _, c := range cases {
+		w := get(c.path, nil)
+		if w.Code != c.status || (c.body != "" && w.Body.String() != c.body) {
+			t.Fatalf("%s: expected %d %q, got %d %q", c.path, c.status, c.body, w.Code, w.Body)
+		}
+		if c.contentType != "" && w.Header().Get("Content-Type") != c.contentType {
+			t.Fatalf("%s: expected Content-Type %q, got %q", c.path, c.contentType, w.Header().Get("Content-Type"))
+		}
+	}
+	if w := get("/static/docs", nil); w.Header().Get("Location") != "/static/docs/" {
+		t.Fatalf("expected a redirect to the directory, got %q", w.Header().Get("Location"))
+	}
+
+	// Conditional requests
+	w := get("/static/js/app.js", nil)
+	if w.Header().Get("X-Local") != "1" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("expected the configured headers, got %v", w.Header())
+	}
+	etag, modified := w.Header().Get("Etag"), w.Header().Get("Last-Modified")
+	if w := get("/static/js/app.js", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for a matching ETag, got %d", w.Code)
+	}
+	if w := get("/static/js/app.js", http.Header{"If-Modified-Since": {modified}}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for If-Modified-Since, got %d", w.Code)
+	}
+
+	// Range requests
+	w = get("/static/media/clip.bin", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("expected bytes 2-5, got %d %q %q", w.Code, w.Body, w.Header().Get("Content-Range"))
+	}
+
+	// Changes are served without reloading, and the old ETag goes stale
+	write("js/app.js", "console.log(2)")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "js", "app.js"), later, later)
+	if w := get("/static/js/app.js", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusOK || w.Body.String() != "console.log(2)" {
+		t.Fatalf("expected the changed file, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestMapLocalFileAndFallback(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "user.json")
+	os.WriteFile(data, []byte(`{"name":"a"}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("app"), 0o644)
+
+	loader, err := echo.NewPluginLoader([]*echo.Plugin{
+		{Match: "api.example.com", MapLocal: &echo.MapLocal{Path: data}},
+		{Match: "spa.example.com", MapLocal: &echo.MapLocal{Path: dir, Fallback: "index.html"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := echo.NewHTTPHandler(loader)
+	for url, expected := range map[string]string{
+		"http://api.example.com/v1/user?id=1": `{"name":"a"}`,
+		"http://spa.example.com/users/42":     "app",
+	} {
+		w := httptest.NewRecorder()
+		handler.HandleRequest(w, httptest.NewRequest("POST", url, strings.NewReader("x")))
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatalf("%s: expected %q, got %d %q", url, expected, w.Code, w.Body)
+		}
+	}
+}
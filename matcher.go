@@ -1,36 +1,598 @@
 package echo
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-// IsMatch checks if a hostname matches a pattern
-// Supports:
-// - Exact match: "example.com"
-// - Wildcard: "*.example.com"
-// - Substring: "example" (matches "example.com", "test.example.com", etc.)
-func IsMatch(hostname, pattern string) bool {
-	// Exact match
-	if hostname == pattern {
+// MatchKind tells how a compiled pattern is compared
+type MatchKind int
+
+const (
+	MatchAny       MatchKind = iota // "*"
+	MatchExact                      // "exact:api.example.com", or a bare IP
+	MatchDomain                     // "example.com", ".example.com", "domain:example.com": host and its subdomains
+	MatchGlob                       // "*.example.com", "api-*.example.com"
+	MatchRegex                      // "/^api\d+\.example\.com$/", "/.../i" for case-insensitive
+	MatchCIDR                       // "10.0.0.0/8", "cidr:fd00::/8"
+	MatchHostPort                   // "example.com:8080", "*.example.com:8443"
+	MatchPath                       // "example.com/api/", "https://*.example.com/v1/*"
+	MatchSubstring                  // "contains:example", opt-in only
+)
+
+func (k MatchKind) String() string {
+	switch k {
+	case MatchAny:
+		return "any"
+	case MatchExact:
+		return "exact"
+	case MatchDomain:
+		return "domain"
+	case MatchGlob:
+		return "glob"
+	case MatchRegex:
+		return "regex"
+	case MatchCIDR:
+		return "cidr"
+	case MatchHostPort:
+		return "host:port"
+	case MatchPath:
+		return "path"
+	case MatchSubstring:
+		return "substring"
+	default:
+		return fmt.Sprintf("MatchKind(%d)", int(k))
+	}
+}
+
+// Matcher is a compiled match pattern. Create it with CompileMatch.
+//
+// A pattern has an optional scheme, a host part, an optional port and an
+// optional path. The host part is one of:
+//   - "*": any host
+//   - "example.com" or ".example.com": the domain and all its subdomains
+//   - "*.example.com": a glob, "*" spans any characters including dots
+//   - a bare IP address: that address only
+//
+// The path is a prefix ("/api/") or, if it contains "*", a glob ("/v1/*")
+// compared with the path and query. Other kinds use a prefix instead:
+// "exact:", "domain:", "glob:", "cidr:", "contains:" and "regex:" (or
+// "/.../"). A regex is compared with the hostname at CONNECT time and with
+// the full URL for requests.
+type Matcher struct {
+	Pattern string
+	Kind    MatchKind
+
+	scheme string
+	host   hostPattern
+	port   string
+	path   string         // path prefix or glob
+	pathRe *regexp.Regexp // path glob, compiled from path
+	re     *regexp.Regexp // MatchRegex
+}
+
+// hostPattern is the host part of a pattern
+type hostPattern struct {
+	kind  MatchKind // MatchAny, MatchExact, MatchDomain, MatchGlob, MatchCIDR or MatchSubstring
+	value string
+	re    *regexp.Regexp
+	ipnet *net.IPNet
+}
+
+// CompileMatch parses a pattern; see Matcher for the syntax
+func CompileMatch(pattern string) (*Matcher, error) {
+	p := strings.TrimSpace(pattern)
+	m := &Matcher{Pattern: pattern}
+	if p == "" {
+		return nil, fmt.Errorf("empty match pattern")
+	}
+
+	if kind, rest, ok := cutKindPrefix(p); ok {
+		if rest == "" {
+			return nil, fmt.Errorf("empty %s pattern", kind)
+		}
+		m.Kind = kind
+		switch kind {
+		case MatchRegex:
+			re, err := regexp.Compile(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", rest, err)
+			}
+			m.re = re
+		case MatchCIDR:
+			_, ipnet, err := net.ParseCIDR(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", rest, err)
+			}
+			m.host = hostPattern{kind: MatchCIDR, ipnet: ipnet}
+		case MatchGlob:
+			m.host = compileHostGlob(rest)
+		default:
+			m.host = hostPattern{kind: kind, value: strings.ToLower(strings.TrimPrefix(rest, "."))}
+		}
+		return m, nil
+	}
+
+	if p == "*" {
+		m.Kind = MatchAny
+		return m, nil
+	}
+
+	// "/regex/" and "/regex/i"
+	if strings.HasPrefix(p, "/") {
+		end := strings.LastIndex(p, "/")
+		flags := p[end+1:]
+		if end > 0 && (flags == "" || flags == "i") {
+			expr := p[1:end]
+			if flags == "i" {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", p, err)
+			}
+			m.Kind = MatchRegex
+			m.re = re
+			return m, nil
+		}
+		return nil, fmt.Errorf("pattern %q has no host", p)
+	}
+
+	if _, ipnet, err := net.ParseCIDR(p); err == nil {
+		m.Kind = MatchCIDR
+		m.host = hostPattern{kind: MatchCIDR, ipnet: ipnet}
+		return m, nil
+	}
+
+	rest := p
+	if i := strings.Index(rest, "://"); i != -1 {
+		m.scheme = strings.ToLower(rest[:i])
+		rest = rest[i+3:]
+	}
+	hostport := rest
+	if i := strings.Index(rest, "/"); i != -1 {
+		hostport, m.path = rest[:i], rest[i:]
+	}
+	host := hostport
+	if h, port, ok := splitPatternPort(hostport); ok {
+		host, m.port = h, port
+	}
+	if host == "" {
+		return nil, fmt.Errorf("pattern %q has no host", p)
+	}
+
+	switch {
+	case host == "*":
+		m.host = hostPattern{kind: MatchAny}
+	case strings.Contains(host, "*"):
+		m.host = compileHostGlob(host)
+	case net.ParseIP(strings.Trim(host, "[]")) != nil:
+		m.host = hostPattern{kind: MatchExact, value: strings.Trim(host, "[]")}
+	default:
+		m.host = hostPattern{kind: MatchDomain, value: strings.ToLower(strings.TrimPrefix(host, "."))}
+	}
+
+	if strings.Contains(m.path, "*") {
+		m.pathRe = regexp.MustCompile(globToRegexp(m.path))
+	}
+
+	switch {
+	case m.path != "":
+		m.Kind = MatchPath
+	case m.port != "":
+		m.Kind = MatchHostPort
+	default:
+		m.Kind = m.host.kind
+	}
+	return m, nil
+}
+
+// cutKindPrefix splits explicit "kind:" prefixes off a pattern
+func cutKindPrefix(p string) (MatchKind, string, bool) {
+	prefixes := []struct {
+		prefix string
+		kind   MatchKind
+	}{
+		{"exact:", MatchExact},
+		{"domain:", MatchDomain},
+		{"glob:", MatchGlob},
+		{"regex:", MatchRegex},
+		{"cidr:", MatchCIDR},
+		{"contains:", MatchSubstring},
+	}
+	for _, pk := range prefixes {
+		if strings.HasPrefix(p, pk.prefix) {
+			return pk.kind, p[len(pk.prefix):], true
+		}
+	}
+	return 0, "", false
+}
+
+// splitPatternPort splits "host:port" and "[v6]:port"; the port must be numeric
+func splitPatternPort(s string) (string, string, bool) {
+	i := strings.LastIndex(s, ":")
+	if i == -1 || strings.Count(s, ":") > 1 && !strings.HasPrefix(s, "[") {
+		return "", "", false
+	}
+	port := s[i+1:]
+	if port == "" {
+		return "", "", false
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return "", "", false
+		}
+	}
+	return strings.Trim(s[:i], "[]"), port, true
+}
+
+func compileHostGlob(glob string) hostPattern {
+	glob = strings.ToLower(glob)
+	return hostPattern{kind: MatchGlob, value: glob, re: regexp.MustCompile(globToRegexp(glob))}
+}
+
+// globToRegexp turns a "*" glob into an anchored regular expression
+func globToRegexp(glob string) string {
+	return "^" + strings.ReplaceAll(regexp.QuoteMeta(glob), "\\*", ".*") + "$"
+}
+
+func (h *hostPattern) match(hostname string) bool {
+	switch h.kind {
+	case MatchAny:
+		return true
+	case MatchExact:
+		return hostname == h.value
+	case MatchDomain:
+		return hostname == h.value || strings.HasSuffix(hostname, "."+h.value)
+	case MatchGlob:
+		return h.re.MatchString(hostname)
+	case MatchCIDR:
+		ip := net.ParseIP(hostname)
+		return ip != nil && h.ipnet.Contains(ip)
+	case MatchSubstring:
+		return strings.Contains(hostname, h.value)
+	}
+	return false
+}
+
+func (h *hostPattern) String() string {
+	switch h.kind {
+	case MatchAny:
+		return "any host"
+	case MatchExact:
+		return fmt.Sprintf("host %s", h.value)
+	case MatchDomain:
+		return fmt.Sprintf("%s or a subdomain", h.value)
+	case MatchGlob:
+		return fmt.Sprintf("host glob %s", h.value)
+	case MatchCIDR:
+		return fmt.Sprintf("IP in %s", h.ipnet)
+	case MatchSubstring:
+		return fmt.Sprintf("host containing %q", h.value)
+	}
+	return "no host"
+}
+
+// String describes what the pattern matches, e.g.
+// `path: example.com or a subdomain, port 8443, path prefix "/api/"`
+func (m *Matcher) String() string {
+	switch m.Kind {
+	case MatchAny:
+		return "any: everything"
+	case MatchRegex:
+		return fmt.Sprintf("regex: %s", m.re)
+	}
+	parts := []string{m.host.String()}
+	if m.scheme != "" {
+		parts = append([]string{"scheme " + m.scheme}, parts...)
+	}
+	if m.port != "" {
+		parts = append(parts, "port "+m.port)
+	}
+	if m.pathRe != nil {
+		parts = append(parts, fmt.Sprintf("path glob %q", m.path))
+	} else if m.path != "" {
+		parts = append(parts, fmt.Sprintf("path prefix %q", m.path))
+	}
+	return m.Kind.String() + ": " + strings.Join(parts, ", ")
+}
+
+// literalHost returns the single hostname an exact or domain pattern
+// names, or ""
+func (m *Matcher) literalHost() string {
+	if m.host.kind == MatchExact || m.host.kind == MatchDomain {
+		return m.host.value
+	}
+	return ""
+}
+
+// MatchHost reports whether the host part of the pattern matches.
+// Scheme and path are ignored; an empty port matches any port pattern.
+// Regex patterns are compared with the hostname.
+func (m *Matcher) MatchHost(hostname, port string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	switch m.Kind {
+	case MatchAny:
 		return true
+	case MatchRegex:
+		return m.re.MatchString(hostname)
+	}
+	if m.port != "" && port != "" && m.port != port {
+		return false
 	}
-	if pattern == "*" {
+	return m.host.match(hostname)
+}
+
+// MatchURL reports whether the pattern matches a request URL
+func (m *Matcher) MatchURL(u *url.URL) bool {
+	switch m.Kind {
+	case MatchAny:
 		return true
+	case MatchRegex:
+		return m.re.MatchString(fullURL(u))
 	}
-	// Wildcard pattern
-	if strings.Contains(pattern, "*") {
-		regexPattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), "\\*", ".*") + "$"
-		matched, err := regexp.MatchString(regexPattern, hostname)
-		if err == nil && matched {
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "" {
+		scheme = "http"
+	}
+	if m.scheme != "" && m.scheme != "*" && normalizeScheme(m.scheme) != normalizeScheme(scheme) {
+		return false
+	}
+	if m.port != "" {
+		port := u.Port()
+		if port == "" {
+			port = defaultPort(scheme)
+		}
+		if m.port != port {
+			return false
+		}
+	}
+	if !m.host.match(strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))) {
+		return false
+	}
+	if m.path == "" {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if m.pathRe != nil {
+		return m.pathRe.MatchString(path)
+	}
+	return strings.HasPrefix(path, m.path)
+}
+
+// fullURL renders scheme://host/path?query for regex matching
+func fullURL(u *url.URL) string {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	s := scheme + "://" + u.Host + u.EscapedPath()
+	if u.RawQuery != "" {
+		s += "?" + u.RawQuery
+	}
+	return s
+}
+
+// normalizeScheme treats ws/wss like http/https
+func normalizeScheme(s string) string {
+	switch s {
+	case "ws":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	return s
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	default:
+		return "80"
+	}
+}
+
+// IsMatch checks if a hostname or URL matches a pattern; see Matcher for
+// the syntax. The pattern is compiled on every call, so hot paths should
+// use CompileMatch once instead.
+func IsMatch(hostname, pattern string) bool {
+	m, err := CompileMatch(pattern)
+	if err != nil {
+		return false
+	}
+	if strings.Contains(hostname, "://") {
+		u, err := url.Parse(hostname)
+		if err != nil {
+			return false
+		}
+		return m.MatchURL(u)
+	}
+	host, port := hostname, ""
+	if h, p, ok := splitPatternPort(hostname); ok {
+		host, port = h, p
+	}
+	return m.MatchHost(host, port)
+}
+
+// valueMatcher matches header and query values: "" requires presence only,
+// "/regex/" is a regular expression, a value with "*" is a glob and anything
+// else must be equal
+type valueMatcher struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+func compileValueMatcher(v string) (*valueMatcher, error) {
+	vm := &valueMatcher{raw: v}
+	switch {
+	case len(v) >= 2 && strings.HasPrefix(v, "/") && strings.HasSuffix(v, "/"):
+		re, err := regexp.Compile(v[1 : len(v)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", v, err)
+		}
+		vm.re = re
+	case strings.Contains(v, "*"):
+		vm.re = regexp.MustCompile(globToRegexp(v))
+	}
+	return vm, nil
+}
+
+func (vm *valueMatcher) match(values []string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if vm.raw == "" {
+		return true
+	}
+	for _, v := range values {
+		if vm.re != nil && vm.re.MatchString(v) || vm.re == nil && v == vm.raw {
 			return true
 		}
 	}
+	return false
+}
+
+// responseMatcher is a compiled ResponseMatch
+type responseMatcher struct {
+	status      [][2]int // inclusive ranges
+	contentType []*regexp.Regexp
+	headers     map[string]*valueMatcher
+	maxBodySize int64
+}
+
+func compileResponseMatch(rm *ResponseMatch) (*responseMatcher, error) {
+	if rm == nil {
+		return nil, nil
+	}
+	c := &responseMatcher{maxBodySize: rm.MaxBodySize}
+	if rm.Status != "" {
+		status, err := parseStatusRanges(rm.Status)
+		if err != nil {
+			return nil, err
+		}
+		c.status = status
+	}
+	for _, ct := range rm.ContentType {
+		c.contentType = append(c.contentType, regexp.MustCompile(globToRegexp(strings.ToLower(strings.TrimSpace(ct)))))
+	}
+	if len(rm.Headers) > 0 {
+		c.headers = make(map[string]*valueMatcher, len(rm.Headers))
+		for k, v := range rm.Headers {
+			vm, err := compileValueMatcher(v)
+			if err != nil {
+				return nil, fmt.Errorf("response header %q: %w", k, err)
+			}
+			c.headers[k] = vm
+		}
+	}
+	return c, nil
+}
 
-	// Substring match
-	if strings.Contains(hostname, pattern) {
+// parseStatusRanges parses "200", "2xx" and "200-299", comma separated
+func parseStatusRanges(s string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		var lo, hi int
+		switch {
+		case len(part) == 3 && strings.HasSuffix(part, "xx") && part[0] >= '1' && part[0] <= '5':
+			lo = int(part[0]-'0') * 100
+			hi = lo + 99
+		case strings.Contains(part, "-"):
+			from, to, _ := strings.Cut(part, "-")
+			var errFrom, errTo error
+			lo, errFrom = strconv.Atoi(from)
+			hi, errTo = strconv.Atoi(to)
+			if errFrom != nil || errTo != nil || fmt.Sprint(lo) != from || fmt.Sprint(hi) != to || lo > hi {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
+		default:
+			if _, err := fmt.Sscanf(part, "%d", &lo); err != nil || fmt.Sprint(lo) != part {
+				return nil, fmt.Errorf("invalid status %q", part)
+			}
+			hi = lo
+		}
+		ranges = append(ranges, [2]int{lo, hi})
+	}
+	return ranges, nil
+}
+
+// match checks res against the conditions. To test MaxBodySize on a body of
+// unknown length it reads up to the limit and puts the bytes back.
+func (c *responseMatcher) match(res *http.Response) bool {
+	if c == nil {
 		return true
 	}
+	if len(c.status) > 0 {
+		ok := false
+		for _, r := range c.status {
+			if res.StatusCode >= r[0] && res.StatusCode <= r[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(c.contentType) > 0 {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(res.Header.Get("Content-Type"), ";")[0]))
+		ok := false
+		for _, re := range c.contentType {
+			if re.MatchString(mediaType) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for k, vm := range c.headers {
+		if !vm.match(res.Header.Values(k)) {
+			return false
+		}
+	}
+	if c.maxBodySize > 0 {
+		return bodyWithin(res, c.maxBodySize)
+	}
+	return true
+}
 
+// bodyWithin reports whether the response body is at most limit bytes
+func bodyWithin(res *http.Response, limit int64) bool {
+	if res.ContentLength >= 0 {
+		return res.ContentLength <= limit
+	}
+	if res.Body == nil {
+		return true
+	}
+	head, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), res.Body), res.Body}
+	if err != nil {
+		return false
+	}
+	if int64(len(head)) <= limit {
+		// The whole body is buffered now, so its length is known
+		res.ContentLength = int64(len(head))
+		return true
+	}
 	return false
 }
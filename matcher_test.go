@@ -22,18 +22,34 @@ func TestIsMatch(t *testing.T) {
 		expected bool
 	}{
 		{"exact host", "example.com", "example.com", true},
-		{"subdomain vs exact host (substring)", "sub.example.com", "example.com", true},
+		{"subdomain vs domain", "sub.example.com", "example.com", true},
+		{"domain is not a substring", "myexample.com", "example.com", false},
+		{"leading dot domain", "a.example.com", ".example.com", true},
+		{"explicit exact", "sub.example.com", "exact:example.com", false},
+		{"explicit exact positive", "example.com", "exact:example.com", true},
 		{"wildcard single-level", "a.example.com", "*.example.com", true},
 		{"wildcard multi-level", "a.b.example.com", "*.example.com", true},
 		{"wildcard has suffix slash", "https://www.baidu.com/", "*.baidu.com/*", true},
 		{"wildcard not root", "example.com", "*.example.com", false},
-		{"substring host positive", "test.example.com", "example", true},
-		{"substring host different TLD", "myexample.net", "example", true},
-		{"substring host negative", "samples.com", "example", false},
+		{"bare word is not a substring", "test.example.com", "example", false},
+		{"substring host positive", "test.example.com", "contains:example", true},
+		{"substring host different TLD", "myexample.net", "contains:example", true},
+		{"substring host negative", "samples.com", "contains:example", false},
 		{"any star matches anything", "anything.com", "*", true},
 		{"url exact", "https://api.example.com/index.html", "https://api.example.com/index.html", true},
+		{"url path prefix", "https://api.example.com/api/data?x=1", "api.example.com/api/", true},
+		{"url path prefix negative", "https://api.example.com/static/a.js", "api.example.com/api/", false},
+		{"url scheme mismatch", "http://api.example.com/", "https://api.example.com/", false},
 		{"url wildcard domain and path", "https://api.example.com/index.html", "https://*.example.com/*", true},
 		{"url wildcard negative", "https://api.other.com/index.html", "https://*.example.com/*", false},
+		{"regex host", "api42.example.com", `/^api\d+\.example\.com$/`, true},
+		{"regex url", "https://example.com/v2/users", `/\/v2\//`, true},
+		{"regex case-insensitive", "API.example.com", "/^api\\./i", true},
+		{"cidr positive", "10.1.2.3", "10.0.0.0/8", true},
+		{"cidr negative", "192.168.1.1", "10.0.0.0/8", false},
+		{"host port positive", "example.com:8443", "example.com:8443", true},
+		{"host port negative", "example.com:443", "example.com:8443", false},
+		{"url default port", "https://example.com/", "example.com:443", true},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
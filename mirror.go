@@ -0,0 +1,447 @@
+package echo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	mirrorBodyLimit   = 1 << 20 // bodies compared, per side
+	maxMirrorDiffs    = 200     // diffs kept, oldest dropped first
+	maxMirrorInFlight = 32      // shadow requests at once; more are skipped
+	maxBodyDiffs      = 20      // JSON differences listed per response
+	mirrorTimeout     = 30 * time.Second
+)
+
+// Response headers that differ between any two servers
+var defaultMirrorIgnoreHeaders = []string{
+	"Age", "Content-Length", "Date", "Etag", "Expires", "Last-Modified", "Server-Timing", "X-Request-Id",
+}
+
+// Mirror sends a copy of each matched request to a shadow target and
+// compares its response with the one the client got: status, headers and
+// body, with JSON bodies compared as values rather than bytes. The client
+// only ever sees the primary response; differences are recorded and
+// available from Echo.MirrorReport.
+type Mirror struct {
+	Target        *TargetConfig `yaml:"target"`
+	IgnoreHeaders []string      `yaml:"ignore_headers"` // in addition to Date, Content-Length, Etag, ...
+	IgnoreFields  []string      `yaml:"ignore_fields"`  // JSON fields as dotted paths, "*" for any key or index: "meta.request_id", "items.*.updated_at"
+}
+
+// MirrorDiff is a shadow response that differed from the primary one, or
+// a shadow request that failed
+type MirrorDiff struct {
+	Time        time.Time `json:"time"`
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`        // where the primary request went
+	ShadowURL   string    `json:"shadow_url"` // where the copy went
+	Error       string    `json:"error,omitempty"`
+	Differences []string  `json:"differences,omitempty"` // "status: 200 != 500", "header Cache-Control: ...", "body $.items[0].name: ..."
+}
+
+// MirrorReport summarizes the mirrored requests since the last clear
+type MirrorReport struct {
+	Compared int          `json:"compared"` // responses compared
+	Differed int          `json:"differed"` // of which differed or failed
+	Skipped  int          `json:"skipped"`  // not mirrored: too many in flight
+	Diffs    []MirrorDiff `json:"diffs"`    // the most recent ones, oldest first
+}
+
+// mirror is a compiled Mirror
+type mirror struct {
+	target        *TargetConfig
+	ignoreHeaders map[string]bool
+	ignoreFields  [][]string
+}
+
+func compileMirror(m *Mirror) (*mirror, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.Target == nil {
+		return nil, errors.New("mirror needs a target")
+	}
+	c := &mirror{target: m.Target, ignoreHeaders: make(map[string]bool)}
+	for _, h := range append(defaultMirrorIgnoreHeaders, m.IgnoreHeaders...) {
+		c.ignoreHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, field := range m.IgnoreFields {
+		c.ignoreFields = append(c.ignoreFields, strings.Split(field, "."))
+	}
+	return c, nil
+}
+
+// mirrorResponse is what is compared of a response
+type mirrorResponse struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool // body over mirrorBodyLimit, not compared
+}
+
+// captureBuffer keeps the first mirrorBodyLimit bytes written to it
+type captureBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	if room := mirrorBodyLimit - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// mirrorLog records the outcome of mirrored requests
+type mirrorLog struct {
+	inFlight int32
+
+	mu       sync.Mutex
+	compared int
+	differed int
+	skipped  int
+	diffs    []MirrorDiff
+}
+
+func (l *mirrorLog) acquire() bool {
+	if atomic.AddInt32(&l.inFlight, 1) > maxMirrorInFlight {
+		atomic.AddInt32(&l.inFlight, -1)
+		l.mu.Lock()
+		l.skipped++
+		l.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (l *mirrorLog) release() {
+	atomic.AddInt32(&l.inFlight, -1)
+}
+
+func (l *mirrorLog) record(d *MirrorDiff) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compared++
+	if d == nil {
+		return
+	}
+	l.differed++
+	l.diffs = append(l.diffs, *d)
+	if len(l.diffs) > maxMirrorDiffs {
+		l.diffs = append(l.diffs[:0:0], l.diffs[len(l.diffs)-maxMirrorDiffs:]...)
+	}
+}
+
+func (l *mirrorLog) report() MirrorReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return MirrorReport{
+		Compared: l.compared,
+		Differed: l.differed,
+		Skipped:  l.skipped,
+		Diffs:    append([]MirrorDiff{}, l.diffs...),
+	}
+}
+
+func (l *mirrorLog) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compared, l.differed, l.skipped, l.diffs = 0, 0, 0, nil
+}
+
+// startMirror sends shadow, a copy of the request taken before it was
+// retargeted, to the mirror target in the background, with the TLS
+// settings of the primary request. The caller sends the primary response
+// on the returned channel once the client has it, or nil if there is
+// nothing to compare.
+func (h *HTTPHandler) startMirror(m *mirror, shadow *http.Request, body []byte, tls *upstreamTLS) chan<- *mirrorResponse {
+	primary := make(chan *mirrorResponse, 1)
+	if !h.mirrors.acquire() {
+		log.Printf("[Mirror] Too many shadow requests in flight, skipping %s", shadow.URL)
+		return primary
+	}
+	primaryURL := shadow.URL.String()
+	shadow.RequestURI = ""
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	// Proxy credentials and the like are for Echo, not the shadow
+	DelHopHeaders(shadow.Header)
+	key := forwardTo(shadow, m.target)
+	key.tls = tls
+	transport, _ := h.transports(key)
+
+	go func() {
+		defer h.mirrors.release()
+		client := &http.Client{
+			Transport: transport,
+			Timeout:   mirrorTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		diff := &MirrorDiff{Time: time.Now(), Method: shadow.Method, URL: primaryURL, ShadowURL: shadow.URL.String()}
+		got, err := readMirrorResponse(client.Do(shadow))
+		want := <-primary
+		if want == nil {
+			return
+		}
+		if err != nil {
+			diff.Error = err.Error()
+		} else {
+			diff.Differences = m.compare(want, got)
+		}
+		if diff.Error == "" && len(diff.Differences) == 0 {
+			diff = nil
+		} else {
+			log.Printf("[Mirror] %s %s differs from %s", diff.Method, diff.ShadowURL, diff.URL)
+		}
+		h.mirrors.record(diff)
+	}()
+	return primary
+}
+
+func readMirrorResponse(res *http.Response, err error) (*mirrorResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body captureBuffer
+	if _, err := io.Copy(&body, res.Body); err != nil {
+		return nil, err
+	}
+	DelHopHeaders(res.Header)
+	return &mirrorResponse{status: res.StatusCode, header: res.Header, body: body.Bytes(), truncated: body.truncated}, nil
+}
+
+// compare lists how shadow differs from primary
+func (m *mirror) compare(primary, shadow *mirrorResponse) []string {
+	var diffs []string
+	if primary.status != shadow.status {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", primary.status, shadow.status))
+	}
+
+	names := make(map[string]bool)
+	for k := range primary.header {
+		names[k] = true
+	}
+	for k := range shadow.header {
+		names[k] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		if !m.ignoreHeaders[k] {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		a, b := headerValue(primary.header, k), headerValue(shadow.header, k)
+		if a != b {
+			diffs = append(diffs, fmt.Sprintf("header %s: %s != %s", k, a, b))
+		}
+	}
+
+	if primary.truncated || shadow.truncated {
+		return diffs
+	}
+	a, errA := decodedBody(primary)
+	b, errB := decodedBody(shadow)
+	if errA != nil || errB != nil {
+		if !bytes.Equal(primary.body, shadow.body) {
+			diffs = append(diffs, "body: differs (not decodable)")
+		}
+		return diffs
+	}
+	var jsonA, jsonB interface{}
+	if decodeJSON(a, &jsonA) == nil && decodeJSON(b, &jsonB) == nil {
+		var bodyDiffs []string
+		m.diffJSON(nil, jsonA, jsonB, &bodyDiffs)
+		if len(bodyDiffs) > maxBodyDiffs {
+			bodyDiffs = append(bodyDiffs[:maxBodyDiffs], fmt.Sprintf("body: %d more differences", len(bodyDiffs)-maxBodyDiffs))
+		}
+		return append(diffs, bodyDiffs...)
+	}
+	if !bytes.Equal(a, b) {
+		diffs = append(diffs, fmt.Sprintf("body: %d bytes != %d bytes", len(a), len(b)))
+	}
+	return diffs
+}
+
+// headerValue formats the values of a header, or "(missing)"
+func headerValue(h http.Header, name string) string {
+	values, ok := h[name]
+	if !ok {
+		return "(missing)"
+	}
+	return strconv.Quote(strings.Join(values, ", "))
+}
+
+// decodedBody returns the body without its Content-Encoding
+func decodedBody(r *mirrorResponse) ([]byte, error) {
+	reader, err := DecompressBody(&http.Response{Header: r.header, Body: io.NopCloser(bytes.NewReader(r.body))})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// decodeJSON decodes a whole JSON document, keeping numbers exact
+func decodeJSON(data []byte, v *interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// diffJSON appends the differences between a and b below path
+func (m *mirror) diffJSON(path []string, a, b interface{}, diffs *[]string) {
+	if m.ignored(path) {
+		return
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make(map[string]bool)
+			for k := range a {
+				keys[k] = true
+			}
+			for k := range b {
+				keys[k] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+			for _, k := range sorted {
+				var x, y interface{} = missing{}, missing{}
+				if v, ok := a[k]; ok {
+					x = v
+				}
+				if v, ok := b[k]; ok {
+					y = v
+				}
+				m.diffJSON(append(path[:len(path):len(path)], k), x, y, diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			n := len(a)
+			if len(b) > n {
+				n = len(b)
+			}
+			for i := 0; i < n; i++ {
+				var x, y interface{} = missing{}, missing{}
+				if i < len(a) {
+					x = a[i]
+				}
+				if i < len(b) {
+					y = b[i]
+				}
+				m.diffJSON(append(path[:len(path):len(path)], strconv.Itoa(i)), x, y, diffs)
+			}
+			return
+		}
+	}
+	x, y := jsonValue(a), jsonValue(b)
+	if x != y {
+		*diffs = append(*diffs, fmt.Sprintf("body %s: %s != %s", jsonPath(path), x, y))
+	}
+}
+
+// missing marks an array element that only one side has
+type missing struct{}
+
+// jsonValue formats a decoded JSON value compactly
+func jsonValue(v interface{}) string {
+	if _, ok := v.(missing); ok {
+		return "(missing)"
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// jsonPath formats path as $.key[0].key
+func jsonPath(path []string) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, seg := range path {
+		if _, err := strconv.Atoi(seg); err == nil {
+			fmt.Fprintf(&b, "[%s]", seg)
+		} else {
+			b.WriteString("." + seg)
+		}
+	}
+	return b.String()
+}
+
+// ignored reports whether path matches one of the ignored fields
+func (m *mirror) ignored(path []string) bool {
+	for _, pattern := range m.ignoreFields {
+		if len(pattern) != len(path) {
+			continue
+		}
+		match := true
+		for i, seg := range pattern {
+			if seg != "*" && seg != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorReport returns the outcome of the requests mirrored by plugins
+// with a Mirror, with the most recent differences
+func (e *Echo) MirrorReport() MirrorReport {
+	return e.httpHandler.mirrors.report()
+}
+
+// ClearMirrorReport forgets the recorded differences and counts
+func (e *Echo) ClearMirrorReport() {
+	e.httpHandler.mirrors.clear()
+}
+
+// MirrorHandler serves MirrorReport as JSON; DELETE clears it
+func (e *Echo) MirrorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(e.MirrorReport())
+		case http.MethodDelete:
+			e.ClearMirrorReport()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package echo_test
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestMirror(t *testing.T) {
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Version", "1")
+		io.WriteString(w, `{"items": [{"id": 1, "name": "a"}], "meta": {"request_id": "p1"}}`)
+	})
+	shadowBodies := make(chan string, 2)
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+			body = []byte("leaked " + auth)
+		}
+		shadowBodies <- string(body)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/same" {
+			w.Header().Set("X-Version", "1")
+			io.WriteString(w, `{"meta":{"request_id":"s1"},"items":[{"name":"a","id":1}]}`)
+			return
+		}
+		w.Header().Set("X-Version", "2")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"items": [{"id": 1, "name": "b"}, {"id": 2}], "meta": {"request_id": "s2"}}`)
+	})
+
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match:  "api.example.com",
+		Target: &echo.TargetConfig{Handler: primary},
+		Mirror: &echo.Mirror{
+			Target:       &echo.TargetConfig{Handler: shadow},
+			IgnoreFields: []string{"meta.request_id"},
+		},
+		// Edits the client sees are not differences
+		OnResponse: func(ctx *echo.Context) {
+			ctx.Res.Header.Set("X-Version", "edited")
+		},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+	client := proxyClient(proxy, "alice")
+
+	for _, path := range []string{"/same", "/diff"} {
+		res, err := client.Post("http://api.example.com"+path, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(body), `"name": "a"`) || res.Header.Get("X-Version") != "edited" {
+			t.Fatalf("expected the primary response, got %d %q", res.StatusCode, body)
+		}
+		if got := <-shadowBodies; got != "payload" {
+			t.Fatalf("expected the shadow to get the request body, got %q", got)
+		}
+	}
+
+	var report echo.MirrorReport
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if report = e.MirrorReport(); report.Compared == 2 {
+			break
+		}
+	}
+	if report.Compared != 2 || report.Differed != 1 || len(report.Diffs) != 1 {
+		t.Fatalf("expected one of two responses to differ, got %+v", report)
+	}
+	diff := report.Diffs[0]
+	expected := []string{
+		"status: 200 != 500",
+		`header X-Version: "1" != "2"`,
+		`body $.items[0].name: "a" != "b"`,
+		`body $.items[1]: (missing) != {"id":2}`,
+	}
+	if strings.Join(diff.Differences, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected differences\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(diff.Differences, "\n"))
+	}
+	if !strings.HasSuffix(diff.URL, "/diff") || diff.Method != http.MethodPost {
+		t.Fatalf("expected the diff to name the request, got %s %s", diff.Method, diff.URL)
+	}
+
+	// The report is served as JSON and cleared with DELETE
+	w := httptest.NewRecorder()
+	e.MirrorHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var served echo.MirrorReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served.Differed != 1 {
+		t.Fatalf("expected the report as JSON, got %v %s", err, w.Body)
+	}
+	e.MirrorHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/", nil))
+	if report := e.MirrorReport(); report.Compared != 0 || len(report.Diffs) != 0 {
+		t.Fatalf("expected the report to be cleared, got %+v", report)
+	}
+}
+
+func TestMirrorUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	e := newTestEcho(t, nil)
+	e.AddPlugin(&echo.Plugin{
+		Match:       "api.example.com",
+		Target:      namedTarget("ok", http.StatusOK),
+		Mirror:      &echo.Mirror{Target: &echo.TargetConfig{Protocol: "https", Host: "127.0.0.1", Port: port}},
+		UpstreamTLS: &echo.UpstreamTLS{RootCAs: []string{writePEM(t, backend.Certificate())}},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+
+	res, err := proxyClient(proxy, "").Get("http://api.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	var report echo.MirrorReport
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if report = e.MirrorReport(); report.Compared == 1 {
+			break
+		}
+	}
+	if report.Compared != 1 || report.Differed != 0 {
+		t.Fatalf("expected the shadow to trust the plugin's root CA, got %+v", report)
+	}
+}
@@ -0,0 +1,96 @@
+package echo
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+)
+
+// connListener is a net.Listener fed by the proxy instead of a socket.
+// Connections taken out of CONNECT tunnels are pushed into it so that one
+// in-process http.Server can serve all of them.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// push hands c to the server, or closes it if the listener is closed
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+// tunnelInfo describes the CONNECT tunnel a connection came from
+type tunnelInfo struct {
+	host       string
+	port       string
+	clientAddr string
+	tls        bool                   // decrypted TLS rather than cleartext HTTP
+	sni        string                 // server name from the ClientHello
+	alpn       []string               // protocols offered in the ClientHello
+	meta       map[string]interface{} // set by OnConnect hooks, read-only afterwards
+	plugins    []*Plugin              // plugins matched at CONNECT time
+}
+
+// tunnelConn is a connection taken out of a CONNECT tunnel
+type tunnelConn struct {
+	net.Conn
+	tunnel *tunnelInfo
+}
+
+type tunnelContextKey struct{}
+
+// withTunnel is used as http.Server.ConnContext for tunnel connections
+func withTunnel(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tunnelConn); ok {
+		return context.WithValue(ctx, tunnelContextKey{}, tc.tunnel)
+	}
+	return ctx
+}
+
+// tunnelFromContext returns the tunnel of a request, or nil for requests
+// that did not arrive through CONNECT
+func tunnelFromContext(ctx context.Context) *tunnelInfo {
+	t, _ := ctx.Value(tunnelContextKey{}).(*tunnelInfo)
+	return t
+}
+
+// bufferedConn reads through a bufio.Reader that may hold peeked bytes
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
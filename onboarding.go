@@ -0,0 +1,210 @@
+package echo
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultOnboardingHost is the host Echo answers itself unless
+// Options.OnboardingHost says otherwise
+const DefaultOnboardingHost = "echo.local"
+
+// onboardingHost returns the reserved host name, or "" when disabled
+func (e *Echo) onboardingHost() string {
+	if e.options.DisableOnboarding {
+		return ""
+	}
+	if e.options.OnboardingHost != "" {
+		return strings.ToLower(e.options.OnboardingHost)
+	}
+	return DefaultOnboardingHost
+}
+
+// isOnboardingRequest reports whether r is for Echo itself rather than to
+// be proxied: a proxy request for the onboarding host, or a request sent
+// to Echo's port as if it were a web server
+func (e *Echo) isOnboardingRequest(r *http.Request) bool {
+	host := e.onboardingHost()
+	if host == "" {
+		return false
+	}
+	if r.URL.Host == "" {
+		return true
+	}
+	return strings.EqualFold(r.URL.Hostname(), host)
+}
+
+// serveOnboarding serves the CA downloads, the PAC file and the setup page
+func (e *Echo) serveOnboarding(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[Onboarding] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ca := e.connectHandler.CertManager.RootCert()
+	switch r.URL.Path {
+	case "/", "/index.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		onboardingPage.Execute(w, onboardingData{
+			Name:      ca.Subject.CommonName,
+			Proxy:     e.proxyAddr(r),
+			Host:      e.onboardingHost(),
+			SHA256:    fingerprint(ca.Raw),
+			NotAfter:  ca.NotAfter.Format("2006-01-02"),
+			Reachable: r.URL.Host == "",
+		})
+	case "/ca.pem", "/ca.crt":
+		serveDownload(w, "application/x-x509-ca-cert", "echo-ca.pem",
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	case "/ca.cer", "/ca.der":
+		serveDownload(w, "application/x-x509-ca-cert", "echo-ca.cer", ca.Raw)
+	case "/ca.mobileconfig":
+		serveDownload(w, "application/x-apple-aspen-config", "echo-ca.mobileconfig",
+			mobileConfig(ca.Subject.CommonName, ca.Raw))
+	case "/proxy.pac":
+		e.PACHandler("").ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// proxyAddr returns the address clients reach Echo at, as seen by r
+func (e *Echo) proxyAddr(r *http.Request) string {
+	if r.URL.Host == "" && r.Host != "" {
+		if _, _, err := net.SplitHostPort(r.Host); err == nil {
+			return r.Host
+		}
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return r.Host
+}
+
+func serveDownload(w http.ResponseWriter, contentType, name string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Write(data)
+}
+
+// fingerprint formats the SHA-256 of der as colon-separated hex
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// payloadUUID derives a stable UUID from der and a label, so reinstalling
+// the profile for the same CA replaces it instead of adding another one
+func payloadUUID(der []byte, label string) string {
+	sum := sha256.Sum256(append([]byte(label), der...))
+	sum[6] = sum[6]&0x0f | 0x40 // version 4 layout
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// mobileConfig returns an Apple configuration profile installing der as a
+// trusted root
+func mobileConfig(name string, der []byte) []byte {
+	profileUUID := payloadUUID(der, "profile")
+	certUUID := payloadUUID(der, "certificate")
+	name = html.EscapeString(name)
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>echo-ca.cer</string>
+			<key>PayloadContent</key>
+			<data>` + base64.StdEncoding.EncodeToString(der) + `</data>
+			<key>PayloadDescription</key>
+			<string>Adds the Echo root CA</string>
+			<key>PayloadDisplayName</key>
+			<string>` + name + `</string>
+			<key>PayloadIdentifier</key>
+			<string>com.github.ltaoo.echo.ca.` + certUUID + `</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>` + certUUID + `</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>` + name + `</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.ltaoo.echo.` + profileUUID + `</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>` + profileUUID + `</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`)
+}
+
+type onboardingData struct {
+	Name      string // CA common name
+	Proxy     string // proxy address
+	Host      string // onboarding host
+	SHA256    string // CA fingerprint
+	NotAfter  string
+	Reachable bool // opened directly rather than through the proxy
+}
+
+var onboardingPage = template.Must(template.New("onboarding").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Echo setup</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+code { background: #f2f2f2; padding: 0 .3em; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Echo setup</h1>
+
+<h2>1. Use the proxy</h2>
+<p>Set the HTTP proxy of this device or browser to <code>{{.Proxy}}</code>,
+or point its automatic proxy configuration at
+<a href="/proxy.pac"><code>http://{{.Proxy}}/proxy.pac</code></a>.</p>
+{{if .Reachable}}<p>Once the proxy is set, this page is also at <a href="http://{{.Host}}/">http://{{.Host}}/</a>.</p>{{end}}
+
+<h2>2. Trust the root certificate</h2>
+<p><b>{{.Name}}</b>, valid until {{.NotAfter}}<br>
+SHA-256 <code>{{.SHA256}}</code></p>
+<ul>
+<li><b>iOS / macOS</b>: install <a href="/ca.mobileconfig">the profile</a>, then on iOS enable it under
+Settings &rsaquo; General &rsaquo; About &rsaquo; Certificate Trust Settings.</li>
+<li><b>Android</b>: download <a href="/ca.cer">echo-ca.cer</a> and install it under
+Settings &rsaquo; Security &rsaquo; Encryption &amp; credentials &rsaquo; Install a certificate &rsaquo; CA certificate.</li>
+<li><b>Windows</b>: open <a href="/ca.cer">echo-ca.cer</a> and install it into
+"Trusted Root Certification Authorities".</li>
+<li><b>Linux / Firefox / other tools</b>: <a href="/ca.pem">echo-ca.pem</a>.</li>
+</ul>
+</body>
+</html>
+`))
@@ -0,0 +1,83 @@
+package echo_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestOnboarding(t *testing.T) {
+	e := newTestEcho(t, nil)
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+	client := proxyClient(proxy, "")
+	proxyAddr := strings.TrimPrefix(proxy.URL, "http://")
+
+	get := func(client *http.Client, url string) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// Through the proxy
+	resp, body := get(client, "http://echo.local/ca.pem")
+	block, _ := pem.Decode([]byte(body))
+	if resp.StatusCode != http.StatusOK || block == nil {
+		t.Fatalf("expected the CA as PEM, got %d %q", resp.StatusCode, body)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	_, body = get(client, "http://echo.local/ca.cer")
+	if !strings.HasPrefix(body, string(block.Bytes)) {
+		t.Fatalf("expected the CA as DER")
+	}
+	resp, body = get(client, "http://echo.local/ca.mobileconfig")
+	if resp.Header.Get("Content-Type") != "application/x-apple-aspen-config" || !strings.Contains(body, "com.apple.security.root") {
+		t.Fatalf("unexpected profile %q", body)
+	}
+	_, body = get(client, "http://echo.local/proxy.pac")
+	if !strings.Contains(body, "FindProxyForURL") || !strings.Contains(body, "PROXY "+proxyAddr) {
+		t.Fatalf("unexpected PAC %q", body)
+	}
+
+	// Directly, as a web server
+	resp, body = get(http.DefaultClient, proxy.URL+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, proxyAddr) {
+		t.Fatalf("expected the setup page with the proxy address, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := get(http.DefaultClient, proxy.URL+"/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestOnboardingDisabled(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{DisableOnboarding: true})
+	e.AddPlugin(&echo.Plugin{
+		Match: "echo.local",
+		OnRequest: func(ctx *echo.Context) {
+			ctx.Mock(http.StatusOK, nil, "proxied")
+		},
+	})
+	proxy := httptest.NewServer(e)
+	defer proxy.Close()
+	resp, err := proxyClient(proxy, "").Get("http://echo.local/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "proxied" {
+		t.Fatalf("expected the request to be proxied, got %q", body)
+	}
+}
@@ -0,0 +1,249 @@
+package echo
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PACScript returns a proxy auto-config script built from the current
+// plugins. Hosts Echo would only tunnel (bypass plugins and lists, and
+// with InterceptOnlyMatched everything unmatched) go DIRECT, the rest to
+// the proxy at proxyAddr. The script reflects the plugins at the time of
+// the call; serve it with PACHandler so clients always fetch a fresh one.
+//
+// Patterns are evaluated on the hostname only. When a pattern cannot be
+// expressed in a PAC script (IPv6 CIDRs, some regexes, client address
+// conditions), the host is sent to Echo, which makes the final decision.
+func (e *Echo) PACScript(proxyAddr string) string {
+	b := newPACBuilder()
+	upstream := e.connectHandler.UpstreamProxy != ""
+	onlyMatched := e.connectHandler.InterceptOnlyMatched
+	for _, cp := range e.pluginLoader.snapshot().compiled {
+		p := cp.plugin
+		switch {
+		case p.Bypass:
+			// Tunneled, through Echo only when it has to use the upstream proxy
+			if (!upstream || p.Direct) && len(cp.clients) == 0 {
+				b.direct.add(cp.matcher, false)
+			}
+		case p.routeOnly():
+			if onlyMatched && len(cp.clients) == 0 {
+				b.direct.add(cp.matcher, false)
+			}
+		default:
+			b.proxy.add(cp.matcher, true)
+		}
+	}
+
+	proxy := "PROXY " + proxyAddr + "; DIRECT"
+	fallback := proxy
+	if onlyMatched && !upstream {
+		fallback = "DIRECT"
+	}
+	return b.script(e.onboardingHost(), proxy, fallback)
+}
+
+// PACHandler serves PACScript. If proxyAddr is empty it is the address the
+// client reached the handler at, which is right when the handler is
+// served by Echo itself.
+func (e *Echo) PACHandler(proxyAddr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := proxyAddr
+		if addr == "" {
+			addr = e.proxyAddr(r)
+		}
+		script := e.PACScript(addr)
+		etag := fmt.Sprintf(`"%x"`, sha1.Sum([]byte(script)))
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, script)
+	})
+}
+
+// pacRules is one outcome of a PAC script: the conditions leading to it
+type pacRules struct {
+	domains map[string]bool // host or a subdomain
+	hosts   map[string]bool // exact host
+	exprs   []string        // other JavaScript conditions on host
+	seen    map[string]bool
+	any     bool
+}
+
+type pacBuilder struct {
+	direct, proxy *pacRules
+}
+
+func newPACBuilder() *pacBuilder {
+	return &pacBuilder{direct: newPACRules(), proxy: newPACRules()}
+}
+
+func newPACRules() *pacRules {
+	return &pacRules{domains: map[string]bool{}, hosts: map[string]bool{}, seen: map[string]bool{}}
+}
+
+// add adds the host part of m. When m cannot be expressed, it matches
+// everything if broad is set and nothing otherwise.
+func (r *pacRules) add(m *Matcher, broad bool) {
+	if m.Kind == MatchAny {
+		r.any = true
+		return
+	}
+	if m.Kind == MatchRegex {
+		// Echo tests plain HTTP requests against the whole URL, which the
+		// script cannot see; such a regex is not expressible
+		if src, ok := jsRegexp(m.re); ok && !urlRegexp(m.re) {
+			r.expr(src + ".test(host)")
+		} else if broad {
+			r.any = true
+		}
+		return
+	}
+	if m.port != "" && !broad {
+		// PAC scripts see no port; only send the whole host DIRECT when
+		// every port of it is
+		return
+	}
+	h := m.host
+	switch h.kind {
+	case MatchAny:
+		r.any = true
+	case MatchExact:
+		r.hosts[h.value] = true
+	case MatchDomain:
+		r.domains[h.value] = true
+	case MatchGlob:
+		r.expr(fmt.Sprintf("shExpMatch(host, %s)", jsString(h.value)))
+	case MatchSubstring:
+		r.expr(fmt.Sprintf("host.indexOf(%s) >= 0", jsString(h.value)))
+	case MatchCIDR:
+		if ip4 := h.ipnet.IP.To4(); ip4 != nil && len(h.ipnet.Mask) == net.IPv4len {
+			mask := net.IP(h.ipnet.Mask).String()
+			r.expr(fmt.Sprintf("isIPv4(host) && isInNet(host, %s, %s)", jsString(ip4.String()), jsString(mask)))
+		} else if broad {
+			r.any = true
+		}
+	}
+}
+
+func (r *pacRules) expr(e string) {
+	if !r.seen[e] {
+		r.seen[e] = true
+		r.exprs = append(r.exprs, e)
+	}
+}
+
+// condition returns the JavaScript condition for the rules, or ""
+func (r *pacRules) condition(name string) string {
+	if r.any {
+		return "true"
+	}
+	var conds []string
+	if len(r.hosts) > 0 {
+		conds = append(conds, name+"Hosts.hasOwnProperty(host)")
+	}
+	if len(r.domains) > 0 {
+		conds = append(conds, "inDomains(host, "+name+"Domains)")
+	}
+	conds = append(conds, r.exprs...)
+	return strings.Join(conds, " ||\n\t    ")
+}
+
+// pacSet names the rules leading to result in the script
+type pacSet struct {
+	name   string
+	result string
+	rules  *pacRules
+}
+
+func (b *pacBuilder) script(onboardingHost, proxy, fallback string) string {
+	sets := []pacSet{{"direct", "DIRECT", b.direct}}
+	if fallback != proxy {
+		// Otherwise whatever is not DIRECT goes to the proxy anyway
+		sets = append(sets, pacSet{"proxy", proxy, b.proxy})
+	}
+
+	var s strings.Builder
+	s.WriteString("// Generated by Echo from its current plugins\n")
+	for _, set := range sets {
+		fmt.Fprintf(&s, "var %sHosts = %s;\n", set.name, jsSet(set.rules.hosts))
+		fmt.Fprintf(&s, "var %sDomains = %s;\n", set.name, jsSet(set.rules.domains))
+	}
+	s.WriteString(`
+function inDomains(host, domains) {
+	for (;;) {
+		if (domains.hasOwnProperty(host)) return true;
+		var dot = host.indexOf(".");
+		if (dot < 0) return false;
+		host = host.substring(dot + 1);
+	}
+}
+
+function isIPv4(host) {
+	return /^\d+\.\d+\.\d+\.\d+$/.test(host);
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+`)
+	if onboardingHost != "" {
+		fmt.Fprintf(&s, "\tif (host == %s) return %s;\n", jsString(onboardingHost), jsString(proxy))
+	}
+	for _, set := range sets {
+		if cond := set.rules.condition(set.name); cond != "" {
+			fmt.Fprintf(&s, "\tif (%s) return %s;\n", cond, jsString(set.result))
+		}
+	}
+	fmt.Fprintf(&s, "\treturn %s;\n}\n", jsString(fallback))
+	return s.String()
+}
+
+// jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// jsSet returns a JavaScript object with the keys of set
+func jsSet(set map[string]bool) string {
+	if len(set) == 0 {
+		return "{}"
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, jsString(k)+": 1")
+	}
+	sort.Strings(keys)
+	return "{\n\t" + strings.Join(keys, ",\n\t") + "\n}"
+}
+
+// urlRegexp reports whether re is written against URLs rather than hosts:
+// it mentions a scheme separator, a port or a path
+func urlRegexp(re *regexp.Regexp) bool {
+	return strings.ContainsAny(strings.ReplaceAll(re.String(), "(?", ""), ":/")
+}
+
+// jsRegexp returns re as a JavaScript RegExp, if the syntax translates:
+// only a leading (?i) flag is converted, other Go-only constructs are
+// rejected
+func jsRegexp(re *regexp.Regexp) (string, bool) {
+	src, flags := re.String(), ""
+	if strings.HasPrefix(src, "(?i)") {
+		src, flags = src[len("(?i)"):], "i"
+	}
+	if strings.Contains(src, "(?") || strings.Contains(src, `\z`) || strings.Contains(src, `\A`) ||
+		strings.Contains(src, `\p`) || strings.Contains(src, "[[:") {
+		return "", false
+	}
+	return fmt.Sprintf("new RegExp(%s, %s)", jsString(src), jsString(flags)), true
+}
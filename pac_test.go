@@ -0,0 +1,90 @@
+package echo_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+func TestPACScript(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{InterceptOnlyMatched: true})
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com", MockResponse: &echo.MockResponse{StatusCode: 200}})
+	e.AddPlugin(&echo.Plugin{Match: "*.cdn.example.net", MockResponse: &echo.MockResponse{StatusCode: 200}})
+	e.AddPlugin(&echo.Plugin{Match: "bank.example.com", Bypass: true})
+
+	script := e.PACScript("127.0.0.1:8888")
+	for _, want := range []string{
+		"function FindProxyForURL(url, host)",
+		`var directDomains = {
+	"bank.example.com": 1
+}`,
+		`var proxyDomains = {
+	"api.example.com": 1
+}`,
+		`shExpMatch(host, "*.cdn.example.net")`,
+		`return "PROXY 127.0.0.1:8888; DIRECT"`,
+		`if (host == "echo.local") return`,
+		"\treturn \"DIRECT\";\n}",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected %q in\n%s", want, script)
+		}
+	}
+
+	// Without InterceptOnlyMatched everything but bypassed hosts goes to Echo
+	all := newTestEcho(t, nil)
+	all.AddPlugin(&echo.Plugin{Match: "bank.example.com", Bypass: true})
+	script = all.PACScript("127.0.0.1:8888")
+	if strings.Contains(script, "proxyDomains") || !strings.HasSuffix(script, "\treturn \"PROXY 127.0.0.1:8888; DIRECT\";\n}\n") {
+		t.Errorf("unexpected script\n%s", script)
+	}
+
+	// A regex written against URLs cannot be tested on the host, so every
+	// request is sent to Echo
+	urls := newTestEcho(t, &echo.Options{InterceptOnlyMatched: true})
+	urls.AddPlugin(&echo.Plugin{Match: `/^http://api\.example\.com/v1/`, MockResponse: &echo.MockResponse{StatusCode: 200}})
+	script = urls.PACScript("127.0.0.1:8888")
+	if strings.Contains(script, "v1") || !strings.Contains(script, `if (true) return "PROXY 127.0.0.1:8888; DIRECT"`) {
+		t.Errorf("expected URL regexes to fall back to the proxy\n%s", script)
+	}
+}
+
+func TestPACHandlerFollowsPlugins(t *testing.T) {
+	e := newTestEcho(t, &echo.Options{InterceptOnlyMatched: true})
+	srv := httptest.NewServer(e.PACHandler("proxy.lan:8888"))
+	defer srv.Close()
+
+	fetch := func(etag string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := fetch("")
+	if resp.Header.Get("Content-Type") != "application/x-ns-proxy-autoconfig" || strings.Contains(body, "api.example.com") {
+		t.Fatalf("unexpected PAC %q", body)
+	}
+	etag := resp.Header.Get("ETag")
+	if resp, _ := fetch(etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", resp.StatusCode)
+	}
+
+	e.AddPlugin(&echo.Plugin{Match: "api.example.com", MockResponse: &echo.MockResponse{StatusCode: 200}})
+	resp, body = fetch(etag)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"api.example.com": 1`) {
+		t.Fatalf("expected the new plugin in the PAC, got %d %q", resp.StatusCode, body)
+	}
+}
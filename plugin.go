@@ -4,20 +4,62 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 // Plugin represents a forwarding rule configuration
 type Plugin struct {
-	Match        string
+	Match        string // See Matcher for the pattern syntax
 	Target       *TargetConfig
+	Targets      []*TargetConfig // several backends chosen by Balance, instead of Target
+	Balance      *Balance
 	MockResponse *MockResponse
+	MapLocal     *MapLocal
 	Bypass       bool // If true, skip MITM and tunnel directly
+	Direct       bool // If true, reach the target without the upstream proxy
+
+	// Optional request conditions; every one that is set must hold.
+	// Query and Headers values: "" only requires presence, "/regex/" is a
+	// regular expression, a value containing "*" is a glob, anything else
+	// must be equal.
+	Methods    []string          // e.g. "GET", "POST"
+	Query      map[string]string // query parameter -> value
+	Headers    map[string]string // request header -> value
+	ClientAddr []string          // client IPs or CIDRs
+
+	// Response limits OnResponse to responses that satisfy it
+	Response *ResponseMatch
+
+	// UpstreamTLS configures TLS towards the server; the last matching
+	// plugin that sets it wins
+	UpstreamTLS *UpstreamTLS
+
+	// Mirror copies requests to a shadow target; the last matching plugin
+	// that sets it wins
+	Mirror *Mirror
 
 	// Hooks
-	OnRequest  func(ctx *Context)
-	OnResponse func(ctx *Context)
+	OnConnect   func(ctx *ConnectContext) // CONNECT tunnels whose host matches
+	OnTCPStream func(s *TCPStream)        // tunnels relayed as raw streams, see TCPStream
+	OnRequest   func(ctx *Context)
+	OnResponse  func(ctx *Context)
+}
+
+// routeOnly reports whether p only chooses how to reach the target
+func (p *Plugin) routeOnly() bool {
+	return p.Direct && !p.Bypass && p.Target == nil && len(p.Targets) == 0 && p.MockResponse == nil && p.MapLocal == nil && p.UpstreamTLS == nil && p.Mirror == nil &&
+		p.OnConnect == nil && p.OnTCPStream == nil && p.OnRequest == nil && p.OnResponse == nil
+}
+
+// ResponseMatch lists response conditions; every one that is set must hold
+type ResponseMatch struct {
+	Status      string            `yaml:"status"`        // "200", "2xx", "200-299,304"
+	ContentType []string          `yaml:"content_type"`  // media type globs, any may match: "text/html", "application/*json"
+	Headers     map[string]string `yaml:"headers"`       // response header -> value, same syntax as Plugin.Headers
+	MaxBodySize int64             `yaml:"max_body_size"` // skip bodies larger than this many bytes as received (0 = no limit)
 }
 
 // Context provides access to the request and response for plugins
@@ -26,6 +68,76 @@ type Context struct {
 	Res *http.Response // Nil in OnRequest
 
 	mockResp *MockResponse
+	tunnel   *tunnelInfo // CONNECT tunnel the request came through, if any
+}
+
+// Get returns metadata an OnConnect hook attached to the connection the
+// request came through, or nil
+func (c *Context) Get(key string) interface{} {
+	if c.tunnel == nil {
+		return nil
+	}
+	return c.tunnel.meta[key]
+}
+
+// ConnectContext is passed to OnConnect hooks before a CONNECT tunnel is
+// established. Hooks run in plugin order; the last decision wins.
+type ConnectContext struct {
+	Req        *http.Request // the CONNECT request
+	Host       string
+	Port       string
+	ClientAddr string
+	User       string // user name from a Basic Proxy-Authorization header
+
+	action   ConnectAction
+	status   int
+	redirect string
+	meta     map[string]interface{}
+}
+
+// Action returns the current decision for the tunnel
+func (c *ConnectContext) Action() ConnectAction {
+	return c.action
+}
+
+// Intercept decrypts the tunnel and runs request-level plugins
+func (c *ConnectContext) Intercept() {
+	c.action = ConnectMITM
+}
+
+// Tunnel relays the tunnel to its target without decrypting it
+func (c *ConnectContext) Tunnel() {
+	c.action = ConnectTunnel
+}
+
+// Reject answers the CONNECT with status instead of opening the tunnel;
+// a status outside 400-599 becomes 403
+func (c *ConnectContext) Reject(status int) {
+	if status < 400 || status > 599 {
+		status = http.StatusForbidden
+	}
+	c.action = ConnectReject
+	c.status = status
+}
+
+// Redirect relays the tunnel to addr ("host:port") without decrypting it
+func (c *ConnectContext) Redirect(addr string) {
+	c.action = ConnectRedirect
+	c.redirect = addr
+}
+
+// Set attaches metadata to the connection; request-level hooks on the same
+// connection read it with Context.Get
+func (c *ConnectContext) Set(key string, value interface{}) {
+	if c.meta == nil {
+		c.meta = make(map[string]interface{})
+	}
+	c.meta[key] = value
+}
+
+// Get returns metadata set by an earlier OnConnect hook
+func (c *ConnectContext) Get(key string) interface{} {
+	return c.meta[key]
 }
 
 // Mock sets a mock response to be returned immediately
@@ -128,11 +240,28 @@ func (c *Context) SetResponseBody(body string) {
 	}
 }
 
-// TargetConfig defines where to forward requests
+// TargetConfig defines where to forward requests. By default the request
+// is sent to Host:Port with that as its Host header and TLS server name;
+// the remaining fields change each of these separately, or replace the
+// network with a Unix socket or an in-process handler.
 type TargetConfig struct {
-	Protocol string // http, https, ws, wss
-	Host     string
-	Port     int
+	Protocol string `yaml:"protocol"` // http, https, ws, wss
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+
+	HostHeader   string `yaml:"host_header"`   // Host header to send instead of Host:Port
+	PreserveHost bool   `yaml:"preserve_host"` // send the client's Host header unchanged
+	ServerName   string `yaml:"server_name"`   // TLS SNI and verified name; defaults to the Host header's host
+	Dial         string `yaml:"dial"`          // "host:port" to connect to instead of Host:Port, bypassing the upstream proxy
+	StripPrefix  string `yaml:"strip_prefix"`  // path prefix removed before forwarding
+	PathPrefix   string `yaml:"path_prefix"`   // path prefix added before forwarding, after StripPrefix
+
+	// Local targets, reached without TCP. Host may be left empty to keep
+	// the request's host.
+	Unix    string       `yaml:"unix"`       // Unix domain socket path
+	Handler http.Handler `yaml:"-" json:"-"` // in-process handler, serves plain HTTP
+
+	Weight int `yaml:"weight"` // share among Plugin.Targets with the weighted strategy, 1 when unset
 }
 
 // MockResponse defines a static response to return
@@ -158,6 +287,73 @@ func (t *TargetConfig) GetHostPort() string {
 	return fmt.Sprintf("%s:%d", t.Host, t.Port)
 }
 
+// httpProtocol returns the scheme used to forward HTTP requests: the
+// configured protocol with ws/wss mapped to http/https, or https for port
+// 443 and http otherwise
+func (t *TargetConfig) httpProtocol() string {
+	switch t.Protocol {
+	case "":
+		if t.Port == 443 {
+			return "https"
+		}
+		return "http"
+	case "ws":
+		return "http"
+	case "wss":
+		return "https"
+	default:
+		return t.Protocol
+	}
+}
+
+// hostHeader returns the Host header to forward a request for original
+// with, or "" to use Host:Port
+func (t *TargetConfig) hostHeader(original string) string {
+	if t.PreserveHost {
+		return original
+	}
+	return t.HostHeader
+}
+
+// serverName returns the TLS server name to use when the request is sent
+// with hostHeader, or "" to use Host
+func (t *TargetConfig) serverName(hostHeader string) string {
+	if t.ServerName != "" || hostHeader == "" {
+		return t.ServerName
+	}
+	if host, _, err := net.SplitHostPort(hostHeader); err == nil {
+		return host
+	}
+	return hostHeader
+}
+
+// rewritePath applies StripPrefix and PathPrefix to the path of u
+func (t *TargetConfig) rewritePath(u *url.URL) {
+	if t.StripPrefix == "" && t.PathPrefix == "" {
+		return
+	}
+	u.Path = t.rewrite(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = t.rewrite(u.RawPath)
+	}
+}
+
+func (t *TargetConfig) rewrite(path string) string {
+	if prefix := strings.TrimSuffix(t.StripPrefix, "/"); prefix != "" && strings.HasPrefix(path, prefix) {
+		// Only whole segments: /api strips /api/v1 but not /apix
+		if rest := path[len(prefix):]; rest == "" || rest[0] == '/' {
+			path = rest
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if prefix := strings.TrimSuffix(t.PathPrefix, "/"); prefix != "" {
+		path = prefix + path
+	}
+	return path
+}
+
 // GetDefaultPort returns the default port for the protocol
 func (t *TargetConfig) GetDefaultPort() int {
 	if t.Port > 0 {
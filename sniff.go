@@ -0,0 +1,220 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"time"
+)
+
+// Protocol is what the first bytes of a tunnel look like
+type Protocol int
+
+const (
+	// ProtocolUnknown is anything else, including protocols where the
+	// server speaks first and the client stays silent
+	ProtocolUnknown Protocol = iota
+	// ProtocolTLS starts with a TLS handshake record
+	ProtocolTLS
+	// ProtocolHTTP1 starts with an HTTP/1.x request line
+	ProtocolHTTP1
+	// ProtocolHTTP2 starts with the cleartext HTTP/2 connection preface
+	ProtocolHTTP2
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTLS:
+		return "tls"
+	case ProtocolHTTP1:
+		return "http/1.x"
+	case ProtocolHTTP2:
+		return "h2c"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultSniffTimeout = 500 * time.Millisecond
+	// sniffReadTimeout bounds reading the rest of a greeting once the
+	// client has started sending it
+	sniffReadTimeout = 5 * time.Second
+	// sniffBufferSize holds the largest TLS record, so a whole ClientHello
+	// can be peeked
+	sniffBufferSize = 5 + 16<<10
+)
+
+var (
+	http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	httpMethods  = [][]byte{
+		[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+		[]byte("OPTIONS "), []byte("PATCH "), []byte("TRACE "), []byte("CONNECT "),
+	}
+)
+
+// sniff classifies a tunnel from the bytes the client sends first, without
+// consuming them from r. A client that sends nothing within timeout is
+// ProtocolUnknown. For TLS the SNI server name is returned when present.
+func sniff(conn net.Conn, r *bufio.Reader, timeout time.Duration) (Protocol, string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if _, err := r.Peek(1); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return ProtocolUnknown, "", nil
+		}
+		return ProtocolUnknown, "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(sniffReadTimeout))
+
+	b, _ := r.Peek(r.Buffered())
+	if b[0] == 0x16 {
+		return ProtocolTLS, peekSNI(r), nil
+	}
+	// Read on while the greeting is still a prefix of something we know
+	for sniffNeedsMore(b) {
+		more, err := r.Peek(len(b) + 1)
+		if err != nil {
+			break
+		}
+		b = more
+	}
+	switch {
+	case bytes.HasPrefix(b, http2Preface):
+		return ProtocolHTTP2, "", nil
+	case isHTTPRequestLine(b):
+		return ProtocolHTTP1, "", nil
+	default:
+		return ProtocolUnknown, "", nil
+	}
+}
+
+func sniffNeedsMore(b []byte) bool {
+	if len(b) < len(http2Preface) && bytes.HasPrefix(http2Preface, b) {
+		return true
+	}
+	for _, m := range httpMethods {
+		if len(b) < len(m) && bytes.HasPrefix(m, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHTTPRequestLine(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// peekSNI reads the server name from a ClientHello without consuming it
+func peekSNI(r *bufio.Reader) string {
+	header, err := r.Peek(5)
+	if err != nil {
+		return ""
+	}
+	n := int(header[3])<<8 | int(header[4])
+	record, err := r.Peek(5 + n)
+	if err != nil {
+		return ""
+	}
+	return parseSNI(record[5:])
+}
+
+// parseSNI returns the server_name extension of a ClientHello handshake
+// message, or "" if it has none or cannot be parsed
+func parseSNI(msg []byte) string {
+	s := helloReader(msg)
+	if t, ok := s.uint8(); !ok || t != 1 { // client_hello
+		return ""
+	}
+	if !s.skip(3 + 2 + 32) { // length, client_version, random
+		return ""
+	}
+	if !s.skipVector(1) || !s.skipVector(2) || !s.skipVector(1) { // session_id, cipher_suites, compression_methods
+		return ""
+	}
+	exts, ok := s.vector(2)
+	if !ok {
+		return ""
+	}
+	for len(exts) > 0 {
+		typ, ok1 := exts.uint16()
+		data, ok2 := exts.vector(2)
+		if !ok1 || !ok2 {
+			return ""
+		}
+		if typ != 0 { // server_name
+			continue
+		}
+		names, ok := data.vector(2)
+		for ok && len(names) > 0 {
+			nameType, ok1 := names.uint8()
+			name, ok2 := names.vector(2)
+			if !ok1 || !ok2 {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// helloReader is a cursor over TLS handshake bytes
+type helloReader []byte
+
+func (s *helloReader) skip(n int) bool {
+	if len(*s) < n {
+		return false
+	}
+	*s = (*s)[n:]
+	return true
+}
+
+func (s *helloReader) uint8() (int, bool) {
+	if len(*s) < 1 {
+		return 0, false
+	}
+	v := int((*s)[0])
+	*s = (*s)[1:]
+	return v, true
+}
+
+func (s *helloReader) uint16() (int, bool) {
+	if len(*s) < 2 {
+		return 0, false
+	}
+	v := int((*s)[0])<<8 | int((*s)[1])
+	*s = (*s)[2:]
+	return v, true
+}
+
+// vector reads a length-prefixed byte string with a lenSize-byte length
+func (s *helloReader) vector(lenSize int) (helloReader, bool) {
+	var n int
+	var ok bool
+	if lenSize == 1 {
+		n, ok = s.uint8()
+	} else {
+		n, ok = s.uint16()
+	}
+	if !ok || len(*s) < n {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *helloReader) skipVector(lenSize int) bool {
+	_, ok := s.vector(lenSize)
+	return ok
+}
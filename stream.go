@@ -0,0 +1,84 @@
+package echo
+
+import (
+	"io"
+)
+
+// TCPStream is passed to OnTCPStream hooks for CONNECT tunnels that are
+// relayed as raw bytes: protocols other than HTTP, including TLS streams
+// Echo decrypted and found not to carry HTTP, and tunnels that bypass MITM.
+// The hook sets the callbacks it needs; each plugin gets its own TCPStream
+// and callbacks of several plugins run in plugin order.
+type TCPStream struct {
+	Host       string // CONNECT target
+	Port       string
+	ClientAddr string
+	SNI        string // TLS server name, if the client sent one
+	TLS        bool   // the bytes are decrypted TLS
+
+	// OnClientData is called with each chunk sent by the client and returns
+	// what to forward to the server; returning nil drops the chunk. The
+	// slice is reused once the callback returns.
+	OnClientData func(data []byte) []byte
+	// OnServerData is the same for chunks sent by the server
+	OnServerData func(data []byte) []byte
+	// OnClose is called once both directions are done
+	OnClose func()
+
+	tunnel *tunnelInfo
+}
+
+// Get returns metadata an OnConnect hook attached to the tunnel, or nil
+func (s *TCPStream) Get(key string) interface{} {
+	return s.tunnel.meta[key]
+}
+
+// streams runs the OnTCPStream hooks of the tunnel's plugins
+func (t *tunnelInfo) streams() []*TCPStream {
+	var streams []*TCPStream
+	for _, p := range t.plugins {
+		if p.OnTCPStream == nil {
+			continue
+		}
+		s := &TCPStream{
+			Host:       t.host,
+			Port:       t.port,
+			ClientAddr: t.clientAddr,
+			SNI:        t.sni,
+			TLS:        t.tls,
+			tunnel:     t,
+		}
+		p.OnTCPStream(s)
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// copyStream copies src to dst chunk by chunk through the callbacks of one
+// direction of streams
+func copyStream(dst io.Writer, src io.Reader, streams []*TCPStream, fromClient bool) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := buf[:n]
+			for _, s := range streams {
+				fn := s.OnServerData
+				if fromClient {
+					fn = s.OnClientData
+				}
+				if fn != nil && len(data) > 0 {
+					data = fn(data)
+				}
+			}
+			if len(data) > 0 {
+				if _, werr := dst.Write(data); werr != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package echo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// UpstreamTLS configures the TLS connections Echo opens to servers for the
+// requests and tunnels a plugin matches: plain HTTP forwarding, requests
+// intercepted from CONNECT tunnels, WebSocket upgrades and decrypted
+// non-HTTP tunnels. Without it the system roots are used with default
+// verification. File paths are read when the plugin is added.
+type UpstreamTLS struct {
+	RootCAs            []string `yaml:"root_cas"`             // PEM files of CAs trusted in addition to the system roots
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"` // accept any certificate (pins are still checked)
+	Pins               []string `yaml:"pins"`                 // SHA-256 of the server certificate or its public key: hex, or "sha256/" + base64
+	ClientCert         string   `yaml:"client_cert"`          // PEM file with a client certificate (and chain) to present
+	ClientKey          string   `yaml:"client_key"`           // PEM file with its key, if not in client_cert
+	MinVersion         string   `yaml:"min_version"`          // "1.0", "1.1", "1.2" or "1.3"
+	ServerName         string   `yaml:"server_name"`          // SNI and verified name instead of the target host
+}
+
+// upstreamTLS is a compiled UpstreamTLS
+type upstreamTLS struct {
+	config     *tls.Config // template, cloned for each use
+	serverName string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// compileUpstreamTLS loads the files of u; nil compiles to nil
+func compileUpstreamTLS(u *UpstreamTLS) (*upstreamTLS, error) {
+	if u == nil {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: u.InsecureSkipVerify}
+
+	if len(u.RootCAs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range u.RootCAs {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("root CA: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("root CA %s: no PEM certificate found", path)
+			}
+		}
+		config.RootCAs = pool
+	}
+
+	if u.ClientCert != "" {
+		certPEM, err := os.ReadFile(u.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		keyPEM := certPEM
+		if u.ClientKey != "" {
+			if keyPEM, err = os.ReadFile(u.ClientKey); err != nil {
+				return nil, fmt.Errorf("client key: %w", err)
+			}
+		}
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate %s: %w", u.ClientCert, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	} else if u.ClientKey != "" {
+		return nil, errors.New("client_key needs client_cert")
+	}
+
+	if u.MinVersion != "" {
+		v, ok := tlsVersions[u.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported min_version %q (supported: 1.0, 1.1, 1.2, 1.3)", u.MinVersion)
+		}
+		config.MinVersion = v
+	}
+
+	if len(u.Pins) > 0 {
+		pins := make([][]byte, len(u.Pins))
+		for i, pin := range u.Pins {
+			sum, err := parsePin(pin)
+			if err != nil {
+				return nil, err
+			}
+			pins[i] = sum
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			leaf := cs.PeerCertificates[0]
+			certSum := sha256.Sum256(leaf.Raw)
+			keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, keySum[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("certificate of %s matches no pin", cs.ServerName)
+		}
+	}
+
+	return &upstreamTLS{config: config, serverName: u.ServerName}, nil
+}
+
+// parsePin decodes a SHA-256 pin: hex (colons allowed) or "sha256/" base64
+func parsePin(pin string) ([]byte, error) {
+	var sum []byte
+	var err error
+	if b64, ok := strings.CutPrefix(pin, "sha256/"); ok {
+		sum, err = base64.StdEncoding.DecodeString(b64)
+	} else {
+		sum, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: want a SHA-256 in hex or sha256/base64", pin)
+	}
+	return sum, nil
+}
+
+// clientConfig returns a tls.Config for a connection to host. A nil
+// upstreamTLS returns the default configuration.
+func (t *upstreamTLS) clientConfig(host string) *tls.Config {
+	if t == nil {
+		return &tls.Config{ServerName: host}
+	}
+	config := t.config.Clone()
+	config.ServerName = host
+	if t.serverName != "" {
+		config.ServerName = t.serverName
+	}
+	return config
+}
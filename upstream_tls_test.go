@@ -0,0 +1,178 @@
+package echo_test
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ltaoo/echo"
+)
+
+// writePEM writes a certificate to a temporary file and returns its path
+func writePEM(t *testing.T, c *x509.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	leaf := backend.Certificate()
+	certSum := sha256.Sum256(leaf.Raw)
+	keySum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	cases := []struct {
+		name     string
+		tls      *echo.UpstreamTLS
+		expected int
+	}{
+		{"system roots", nil, http.StatusBadGateway},
+		{"root CA", &echo.UpstreamTLS{RootCAs: []string{writePEM(t, leaf)}}, http.StatusOK},
+		{"skip verify", &echo.UpstreamTLS{InsecureSkipVerify: true}, http.StatusOK},
+		{"certificate pin", &echo.UpstreamTLS{InsecureSkipVerify: true, Pins: []string{hex.EncodeToString(certSum[:])}}, http.StatusOK},
+		{"key pin", &echo.UpstreamTLS{InsecureSkipVerify: true, Pins: []string{"sha256/" + base64.StdEncoding.EncodeToString(keySum[:])}}, http.StatusOK},
+		{"wrong pin", &echo.UpstreamTLS{InsecureSkipVerify: true, Pins: []string{strings.Repeat("00", sha256.Size)}}, http.StatusBadGateway},
+		{"server name", &echo.UpstreamTLS{RootCAs: []string{writePEM(t, leaf)}, ServerName: "example.com"}, http.StatusOK},
+		{"wrong server name", &echo.UpstreamTLS{RootCAs: []string{writePEM(t, leaf)}, ServerName: "other.test"}, http.StatusBadGateway},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := proxyGet(t, backend.URL+"/", &echo.Plugin{Match: "127.0.0.1", UpstreamTLS: tc.tls})
+			if res.StatusCode != tc.expected {
+				t.Fatalf("expected %d, got %d", tc.expected, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLSClientCertificate(t *testing.T) {
+	certPEM, keyPEM := testCA(t)
+	block, _ := pem.Decode(certPEM)
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	backend.StartTLS()
+	defer backend.Close()
+
+	res := proxyGet(t, backend.URL+"/", &echo.Plugin{Match: "127.0.0.1", UpstreamTLS: &echo.UpstreamTLS{InsecureSkipVerify: true}})
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected the handshake to fail without a client certificate, got %d", res.StatusCode)
+	}
+
+	// Certificate and key in one file
+	path := filepath.Join(t.TempDir(), "client.pem")
+	os.WriteFile(path, append(certPEM, keyPEM...), 0o600)
+	res = proxyGet(t, backend.URL+"/", &echo.Plugin{Match: "127.0.0.1", UpstreamTLS: &echo.UpstreamTLS{
+		InsecureSkipVerify: true,
+		ClientCert:         path,
+	}})
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "Echo Test CA" {
+		t.Fatalf("expected the client certificate to be presented, got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestUpstreamTLSWebSocket(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	upgrade := func(u *echo.UpstreamTLS) string {
+		t.Helper()
+		loader, err := echo.NewPluginLoader([]*echo.Plugin{{
+			Match:       "ws.example.com",
+			Target:      &echo.TargetConfig{Protocol: "wss", Host: "127.0.0.1", Port: port},
+			UpstreamTLS: u,
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &echo.WebSocketHandler{PluginLoader: loader}
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.HandleUpgrade(w, r, false)
+		}))
+		defer proxy.Close()
+
+		conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: ws.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		status, _ := bufio.NewReader(conn).ReadString('\n')
+		return strings.TrimSpace(status)
+	}
+
+	if status := upgrade(nil); !strings.Contains(status, "502") {
+		t.Fatalf("expected an unverified backend to be refused, got %q", status)
+	}
+	if status := upgrade(&echo.UpstreamTLS{RootCAs: []string{writePEM(t, backend.Certificate())}}); !strings.Contains(status, "101") {
+		t.Fatalf("expected the upgrade with the backend's CA trusted, got %q", status)
+	}
+}
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := testCA(t)
+	os.WriteFile(filepath.Join(dir, "client.crt"), certPEM, 0o644)
+	os.WriteFile(filepath.Join(dir, "client.key"), keyPEM, 0o600)
+	path := filepath.Join(dir, "echo.yaml")
+	os.WriteFile(path, []byte(`plugins:
+  - match: api.example.com
+    upstream_tls:
+      client_cert: client.crt
+      client_key: client.key
+      min_version: "1.2"
+`), 0o644)
+	cfg, err := echo.LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("expected paths relative to the config file to load: %v", err)
+	}
+	if got := cfg.Plugins[0].ToPlugin().UpstreamTLS.ClientCert; got != filepath.Join(dir, "client.crt") {
+		t.Fatalf("expected the client certificate path to be resolved, got %q", got)
+	}
+
+	_, err = echo.ParseConfig([]byte(`plugins:
+  - match: api.example.com
+    upstream_tls:
+      min_version: "1.4"
+`))
+	if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "min_version") {
+		t.Fatalf("expected an error at the upstream_tls line, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -39,24 +40,45 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 	targetHost := r.Host
 	targetProtocol := protocol
 	targetPath := path
+	hostHeader := targetHost
+	serverName := ""
+	dialHost := ""
 
-	// Find all matching plugins; apply OnRequest hooks and choose last Target
-	matched_plugins := h.PluginLoader.MatchPluginsForRequest(r)
+	// Find all matching plugins; apply OnRequest hooks and choose last Target(s)
+	matched_plugins := h.PluginLoader.matchRequest(r)
+	var target_plugin *compiledPlugin
 	var selected_target *TargetConfig
+	var selected_balancer *balancer
+	var selected_tls *upstreamTLS
 	if len(matched_plugins) > 0 {
-		ctx := &Context{Req: r}
-		for _, p := range matched_plugins {
+		ctx := &Context{Req: r, tunnel: tunnelFromContext(r.Context())}
+		for _, cp := range matched_plugins {
+			p := cp.plugin
 			if p.OnRequest != nil {
 				p.OnRequest(ctx)
 			}
-			if p.Target != nil {
-				selected_target = p.Target
+			if p.Target != nil || cp.balancer != nil {
+				target_plugin = cp
 			}
+			if cp.tls != nil {
+				selected_tls = cp.tls
+			}
+		}
+		if target_plugin != nil {
+			selected_target, selected_balancer = target_plugin.target(r)
 		}
 		if selected_target != nil {
-			targetHost = selected_target.GetHostPort()
+			targetHost = selected_target.forwardHost(r.Host)
 			targetProtocol = selected_target.Protocol
-			targetPath = path
+			u := *r.URL
+			selected_target.rewritePath(&u)
+			targetPath = u.RequestURI()
+			hostHeader = targetHost
+			if host := selected_target.hostHeader(r.Host); host != "" {
+				hostHeader = host
+			}
+			serverName = selected_target.serverName(selected_target.hostHeader(r.Host))
+			dialHost = selected_target.Dial
 
 			if targetProtocol == "" {
 				if selected_target.Port == 443 {
@@ -76,7 +98,9 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 	}
 
 	// Clean up host for Dial
-	dialHost := targetHost
+	if dialHost == "" {
+		dialHost = targetHost
+	}
 	if !strings.Contains(dialHost, ":") {
 		if targetProtocol == "wss" {
 			dialHost += ":443"
@@ -92,15 +116,33 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 	var backendConn net.Conn
 	var err error
 
-	if targetProtocol == "wss" {
-		// Use TLS for secure WebSocket connections
-		conf := &tls.Config{InsecureSkipVerify: true}
-		backendConn, err = tls.Dial("tcp", dialHost, conf)
+	if selected_target != nil && selected_target.local() {
+		// Unix socket or in-process handler, no TCP hop
+		backendConn, err = selected_target.dialLocal(r.Context())
 	} else {
-		// Use standard TCP for non-secure WebSocket connections (ws://)
 		backendConn, err = net.Dial("tcp", dialHost)
 	}
+	if err == nil && targetProtocol == "wss" {
+		// Use TLS for secure WebSocket connections, verified unless the
+		// plugin's UpstreamTLS says otherwise
+		host := targetHost
+		if h, _, err := net.SplitHostPort(targetHost); err == nil {
+			host = h
+		}
+		conf := selected_tls.clientConfig(host)
+		if serverName != "" {
+			conf.ServerName = serverName
+		}
+		tlsConn := tls.Client(backendConn, conf)
+		if err = tlsConn.Handshake(); err != nil {
+			backendConn.Close()
+		}
+		backendConn = tlsConn
+	}
 
+	if selected_balancer != nil && err != nil {
+		selected_balancer.report(selected_target, false)
+	}
 	if err != nil {
 		log.Printf("[WS Error] Failed to connect to backend %s: %v", dialHost, err)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
@@ -126,7 +168,7 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 	backendConn.Write([]byte(reqLine))
 
 	// Ensure Host header is present
-	r.Header.Set("Host", targetHost)
+	r.Header.Set("Host", hostHeader)
 	// Restore hop-by-hop headers removed by Go's http.Server
 	r.Header.Set("Connection", "Upgrade")
 	r.Header.Set("Upgrade", "websocket")
@@ -137,6 +179,9 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 	// Read the response status line
 	bufBackend := bufio.NewReader(backendConn)
 	statusLine, err := bufBackend.ReadString('\n')
+	if selected_balancer != nil {
+		selected_balancer.report(selected_target, err == nil && healthyStatus(statusCode(statusLine)))
+	}
 	if err != nil {
 		log.Printf("[WS Error] Failed to read status line: %v", err)
 		return
@@ -187,3 +232,13 @@ func (h *WebSocketHandler) HandleUpgrade(w http.ResponseWriter, r *http.Request,
 		io.Copy(backendConn, clientConn)
 	}()
 }
+
+// statusCode returns the code of an HTTP status line, or 0
+func statusCode(statusLine string) int {
+	fields := strings.Fields(statusLine)
+	if len(fields) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(fields[1])
+	return code
+}